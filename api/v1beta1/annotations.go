@@ -0,0 +1,39 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+// Annotations recognized by the step issuer on CertificateRequest resources.
+const (
+	// PriorityAnnotationKey is the annotation used to change the priority in
+	// which a CertificateRequest is signed.
+	PriorityAnnotationKey = "certmanager.step.sm/priority"
+
+	// PriorityUrgent is the value of the priority annotation that makes
+	// CertificateRequests skip the queue of regular requests.
+	PriorityUrgent = "urgent"
+
+	// ProfileAnnotationKey is the annotation used to select the StepIssuer
+	// profile that will sign a CertificateRequest.
+	ProfileAnnotationKey = "certmanager.step.sm/profile"
+)
+
+// Annotations set by stepissuerctl on Certificate resources.
+const (
+	// MigratedFromAnnotationKey is the annotation with the issuer used by a
+	// Certificate before being migrated to a StepIssuer, in the format
+	// <kind>/<name>.
+	MigratedFromAnnotationKey = "certmanager.step.sm/migrated-from"
+)
@@ -16,6 +16,7 @@ limitations under the License.
 package v1beta1
 
 import (
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -37,11 +38,45 @@ type StepIssuerSpec struct {
 	// Provisioner contains the step certificates provisioner configuration.
 	Provisioner StepProvisioner `json:"provisioner"`
 
+	// Profiles is a list of named profiles that CertificateRequests can select
+	// using the certmanager.step.sm/profile annotation. Each profile signs
+	// with its own provisioner, CertificateRequests without the annotation are
+	// signed using the default provisioner.
+	// +optional
+	Profiles []StepProfile `json:"profiles,omitempty"`
+
 	// CABundle is a base64 encoded TLS certificate used to verify connections
 	// to the step certificates server. If not set the system root certificates
 	// are used to validate the TLS connection.
 	// +optional
 	CABundle []byte `json:"caBundle,omitempty"`
+
+	// ClientCertificateRef is a reference to a kubernetes.io/tls Secret
+	// containing the client certificate and key used to authenticate all the
+	// connections to step certificates. It must be set if the CA requires
+	// client authentication on every endpoint, in this case CABundle is
+	// required and the roots in it are used without contacting the CA.
+	// +optional
+	ClientCertificateRef *SecretReference `json:"clientCertificateRef,omitempty"`
+
+	// Backdate is the time subtracted from the current time to set the
+	// NotBefore of the certificates. If set, the validity of the certificates
+	// is computed using the time of the step issuer instead of the time of the
+	// CA. It should not be greater than the backdate configured in the CA.
+	// +optional
+	Backdate *metav1.Duration `json:"backdate,omitempty"`
+
+	// Policy contains the restrictions enforced by the step issuer before
+	// sending a certificate request to step certificates.
+	// +optional
+	Policy *StepPolicy `json:"policy,omitempty"`
+
+	// FallbackIssuerName is the name of another StepIssuer in the same
+	// namespace used to sign the renewals that fail with this one when the
+	// current certificate is about to expire. The controller flag
+	// -expiry-danger-window sets how close to the expiration it is used.
+	// +optional
+	FallbackIssuerName string `json:"fallbackIssuerName,omitempty"`
 }
 
 // StepIssuerStatus defines the observed state of StepIssuer
@@ -51,6 +86,11 @@ type StepIssuerStatus struct {
 
 	// +optional
 	Conditions []StepIssuerCondition `json:"conditions,omitempty"`
+
+	// CA contains the latency and outcome of the recent requests to step
+	// certificates.
+	// +optional
+	CA *StepCAStatus `json:"ca,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -84,6 +124,12 @@ type SecretKeySelector struct {
 	Key string `json:"key,omitempty"`
 }
 
+// SecretReference contains the reference to a secret.
+type SecretReference struct {
+	// The name of the secret in the pod's namespace to select from.
+	Name string `json:"name"`
+}
+
 // StepProvisioner contains the configuration used to create step certificate
 // tokens used to grant certificates.
 type StepProvisioner struct {
@@ -98,6 +144,52 @@ type StepProvisioner struct {
 	PasswordRef SecretKeySelector `json:"passwordRef"`
 }
 
+// StepProfile is a named configuration that can be selected by the
+// CertificateRequests signed by a StepIssuer.
+type StepProfile struct {
+	// Name is the name of the profile.
+	Name string `json:"name"`
+
+	// Provisioner contains the step certificates provisioner configuration
+	// used to sign the CertificateRequests selecting this profile.
+	Provisioner StepProvisioner `json:"provisioner"`
+}
+
+// StepPolicy contains the restrictions applied to the certificate requests
+// signed by a StepIssuer.
+type StepPolicy struct {
+	// AllowedSANTypes is the list of subject alternative name types that can be
+	// requested, one of ('DNS', 'IP', 'URI', 'Email'). If empty all types are
+	// allowed.
+	// +optional
+	AllowedSANTypes []SANType `json:"allowedSANTypes,omitempty"`
+
+	// AllowedUsages is the list of key usages and extended key usages that
+	// can be requested, using the cert-manager names, e.g. 'server auth'.
+	// Both the usages of the CertificateRequest and the extensions in the
+	// CSR are checked. If empty all usages are allowed.
+	// +optional
+	AllowedUsages []certmanager.KeyUsage `json:"allowedUsages,omitempty"`
+}
+
+// SANType represents a subject alternative name type.
+// +kubebuilder:validation:Enum=DNS;IP;URI;Email
+type SANType string
+
+const (
+	// SANTypeDNS represents DNS name SANs.
+	SANTypeDNS SANType = "DNS"
+
+	// SANTypeIP represents IP address SANs.
+	SANTypeIP SANType = "IP"
+
+	// SANTypeURI represents URI SANs.
+	SANTypeURI SANType = "URI"
+
+	// SANTypeEmail represents email address SANs.
+	SANTypeEmail SANType = "Email"
+)
+
 // ConditionType represents a StepIssuer condition type.
 // +kubebuilder:validation:Enum=Ready
 type ConditionType string
@@ -127,6 +219,54 @@ const (
 	ConditionUnknown ConditionStatus = "Unknown"
 )
 
+// StepCAStatus contains the latency and outcome of the recent requests to step
+// certificates.
+type StepCAStatus struct {
+	// LastProbeTime is the timestamp of the last health check to the CA.
+	// +optional
+	LastProbeTime *metav1.Time `json:"lastProbeTime,omitempty"`
+
+	// LastProbeLatency is the latency of the last health check to the CA.
+	// +optional
+	LastProbeLatency *metav1.Duration `json:"lastProbeLatency,omitempty"`
+
+	// LastProbeResult is the outcome of the last health check to the CA, one
+	// of ('Success', 'Failure').
+	// +optional
+	LastProbeResult ProbeResult `json:"lastProbeResult,omitempty"`
+
+	// LastProbeMessage is the error returned by the last health check to the
+	// CA if it failed.
+	// +optional
+	LastProbeMessage string `json:"lastProbeMessage,omitempty"`
+
+	// LatencyP95 is the 95th percentile of the latency of the recent requests
+	// to the CA.
+	// +optional
+	LatencyP95 *metav1.Duration `json:"latencyP95,omitempty"`
+
+	// RecentRequests is the number of recent requests used to compute the
+	// latency.
+	// +optional
+	RecentRequests int `json:"recentRequests,omitempty"`
+
+	// RecentFailures is the number of recent requests to the CA that failed.
+	// +optional
+	RecentFailures int `json:"recentFailures,omitempty"`
+}
+
+// ProbeResult represents the outcome of a health check to the CA.
+// +kubebuilder:validation:Enum=Success;Failure
+type ProbeResult string
+
+const (
+	// ProbeSuccess indicates that the CA health check succeeded.
+	ProbeSuccess ProbeResult = "Success"
+
+	// ProbeFailure indicates that the CA health check failed.
+	ProbeFailure ProbeResult = "Failure"
+)
+
 // StepIssuerCondition contains condition information for the step issuer.
 type StepIssuerCondition struct {
 	// Type of the condition, currently ('Ready').
@@ -20,6 +20,8 @@ limitations under the License.
 package v1beta1
 
 import (
+	certmanagerv1 "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -38,6 +40,50 @@ func (in *SecretKeySelector) DeepCopy() *SecretKeySelector {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReference) DeepCopyInto(out *SecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReference.
+func (in *SecretReference) DeepCopy() *SecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StepCAStatus) DeepCopyInto(out *StepCAStatus) {
+	*out = *in
+	if in.LastProbeTime != nil {
+		in, out := &in.LastProbeTime, &out.LastProbeTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastProbeLatency != nil {
+		in, out := &in.LastProbeLatency, &out.LastProbeLatency
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LatencyP95 != nil {
+		in, out := &in.LatencyP95, &out.LatencyP95
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StepCAStatus.
+func (in *StepCAStatus) DeepCopy() *StepCAStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StepCAStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StepIssuer) DeepCopyInto(out *StepIssuer) {
 	*out = *in
@@ -120,11 +166,31 @@ func (in *StepIssuerList) DeepCopyObject() runtime.Object {
 func (in *StepIssuerSpec) DeepCopyInto(out *StepIssuerSpec) {
 	*out = *in
 	out.Provisioner = in.Provisioner
+	if in.Profiles != nil {
+		in, out := &in.Profiles, &out.Profiles
+		*out = make([]StepProfile, len(*in))
+		copy(*out, *in)
+	}
 	if in.CABundle != nil {
 		in, out := &in.CABundle, &out.CABundle
 		*out = make([]byte, len(*in))
 		copy(*out, *in)
 	}
+	if in.ClientCertificateRef != nil {
+		in, out := &in.ClientCertificateRef, &out.ClientCertificateRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+	if in.Backdate != nil {
+		in, out := &in.Backdate, &out.Backdate
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Policy != nil {
+		in, out := &in.Policy, &out.Policy
+		*out = new(StepPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StepIssuerSpec.
@@ -147,6 +213,11 @@ func (in *StepIssuerStatus) DeepCopyInto(out *StepIssuerStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.CA != nil {
+		in, out := &in.CA, &out.CA
+		*out = new(StepCAStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StepIssuerStatus.
@@ -159,6 +230,47 @@ func (in *StepIssuerStatus) DeepCopy() *StepIssuerStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StepPolicy) DeepCopyInto(out *StepPolicy) {
+	*out = *in
+	if in.AllowedSANTypes != nil {
+		in, out := &in.AllowedSANTypes, &out.AllowedSANTypes
+		*out = make([]SANType, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedUsages != nil {
+		in, out := &in.AllowedUsages, &out.AllowedUsages
+		*out = make([]certmanagerv1.KeyUsage, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StepPolicy.
+func (in *StepPolicy) DeepCopy() *StepPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(StepPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StepProfile) DeepCopyInto(out *StepProfile) {
+	*out = *in
+	out.Provisioner = in.Provisioner
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StepProfile.
+func (in *StepProfile) DeepCopy() *StepProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(StepProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StepProvisioner) DeepCopyInto(out *StepProvisioner) {
 	*out = *in
@@ -0,0 +1,195 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command step-signer runs the provisioners of a StepIssuer as a standalone
+// REST signing service, without any dependency on the Kubernetes API.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/smallstep/step-issuer/provisioners"
+	"github.com/smallstep/step-issuer/signer"
+	"k8s.io/utils/clock"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var setupLog = logf.Log.WithName("setup")
+
+func main() {
+	var addr string
+	var configFile string
+	var secretsDir string
+	var tokensFile string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var insecure bool
+	var clockSkew time.Duration
+	var onDemandKeys bool
+	var fips bool
+
+	// Options for configuring logging
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+
+	flag.StringVar(&addr, "addr", ":8443", "The address the signing service binds to.")
+	flag.StringVar(&configFile, "config", "",
+		"The StepIssuer manifest with the configuration of the CA, the provisioners and the policy.")
+	flag.StringVar(&secretsDir, "secrets-dir", "/var/run/secrets/step-signer",
+		"The directory with the secrets referenced by the StepIssuer, a key is read from <dir>/<secret name>/<key>.")
+	flag.StringVar(&tokensFile, "tokens-file", "",
+		"The file with the bearer tokens allowed to sign certificates, one per line.")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "The certificate used to serve HTTPS.")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "The private key used to serve HTTPS.")
+	flag.BoolVar(&insecure, "insecure", false,
+		"Serves plain HTTP instead of HTTPS, the bearer tokens and certificates are sent in the clear.")
+	flag.DurationVar(&clockSkew, "clock-skew", 0,
+		"The offset added to the local clock to match the clock of the CA.")
+	flag.BoolVar(&onDemandKeys, "on-demand-provisioner-keys", false,
+		"Reads the provisioner passwords and decrypts the keys every time a certificate is signed instead of keeping them in memory.")
+	flag.BoolVar(&fips, "fips", false,
+		"Restricts the certificate requests, keys and TLS settings to FIPS approved algorithms. Requires a binary built with BoringCrypto.")
+	flag.Parse()
+
+	logf.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if configFile == "" || tokensFile == "" {
+		setupLog.Info("flags -config and -tokens-file are required")
+		os.Exit(1)
+	}
+	switch {
+	case (tlsCertFile == "") != (tlsKeyFile == ""):
+		setupLog.Info("flags -tls-cert-file and -tls-key-file must be used together")
+		os.Exit(1)
+	case tlsCertFile == "" && !insecure:
+		setupLog.Info("flags -tls-cert-file and -tls-key-file are required, use -insecure to serve plain HTTP")
+		os.Exit(1)
+	case tlsCertFile != "" && insecure:
+		setupLog.Info("flag -insecure cannot be used with -tls-cert-file and -tls-key-file")
+		os.Exit(1)
+	case insecure && fips:
+		setupLog.Info("flag -insecure cannot be used with -fips")
+		os.Exit(1)
+	}
+	if fips && !provisioners.FIPSCapable() {
+		setupLog.Info("flag -fips requires a binary built with a FIPS capable crypto backend")
+		os.Exit(1)
+	}
+
+	iss, err := signer.LoadIssuer(configFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load configuration")
+		os.Exit(1)
+	}
+	tokens, err := readTokens(tokensFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load tokens")
+		os.Exit(1)
+	}
+
+	clk := provisioners.NewSkewedClock(clock.RealClock{}, clockSkew)
+	provOpts := []provisioners.Option{
+		provisioners.WithClock(clk),
+		provisioners.WithLogger(logf.Log.WithName("provisioner")),
+	}
+	if onDemandKeys {
+		provOpts = append(provOpts, provisioners.WithOnDemandKeys())
+	}
+	if fips {
+		provOpts = append(provOpts, provisioners.WithFIPS())
+	}
+	p, err := signer.NewProvisioner(iss, signer.Secrets(secretsDir), provOpts...)
+	if err != nil {
+		setupLog.Error(err, "unable to initialize provisioner")
+		os.Exit(1)
+	}
+	defer p.Close()
+
+	srv := &http.Server{
+		Addr: addr,
+		Handler: (&signer.Server{
+			Provisioner: p,
+			Policy:      iss.Spec.Policy,
+			Tokens:      tokens,
+			Log:         logf.Log.WithName("signer"),
+		}).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute,
+	}
+	if fips {
+		srv.TLSConfig = &tls.Config{}
+		provisioners.ConfigureFIPSTLS(srv.TLSConfig)
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			setupLog.Error(err, "error shutting down server")
+		}
+	}()
+
+	setupLog.Info("starting signer", "addr", addr, "url", iss.Spec.URL)
+	if insecure {
+		setupLog.Info("serving plain HTTP, use -tls-cert-file and -tls-key-file to serve HTTPS")
+		err = srv.ListenAndServe()
+	} else {
+		err = srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		setupLog.Error(err, "problem running signer")
+		p.Close()
+		os.Exit(1)
+	}
+}
+
+// readTokens returns the non-empty lines in the given file.
+func readTokens(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if t := strings.TrimSpace(scanner.Text()); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s does not contain any token", filename)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,236 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// migration is a Certificate moved to a StepIssuer, it is re-issued once its
+// revision is greater than the one before the migration.
+type migration struct {
+	key        types.NamespacedName
+	revision   int
+	generation int64
+	done       bool
+}
+
+func runMigrate(args []string) error {
+	var namespace, fromKind, fromName, to string
+	var apply, waitReissue bool
+	var interval, timeout time.Duration
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&namespace, "namespace", "", "The namespace of the Certificates, all namespaces are used if it is empty.")
+	fs.StringVar(&fromKind, "from-kind", "Issuer", "The kind of the current issuer, Issuer or ClusterIssuer.")
+	fs.StringVar(&fromName, "from-name", "", "The name of the current issuer.")
+	fs.StringVar(&to, "to", "", "The name of the StepIssuer, it must exist in the namespace of every Certificate.")
+	fs.BoolVar(&apply, "apply", false, "Rewrites the issuerRef of the Certificates, without it only the changes are printed.")
+	fs.BoolVar(&waitReissue, "wait", false, "Waits until the migrated Certificates have been re-issued.")
+	fs.DurationVar(&interval, "interval", 10*time.Second, "The interval at which the re-issuance progress is checked.")
+	fs.DurationVar(&timeout, "timeout", 30*time.Minute, "The maximum time to wait for the Certificates to be re-issued.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: stepissuerctl migrate -from-name <issuer> -to <stepissuer> [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Rewrites the issuerRef of the Certificates using the given issuer to a StepIssuer.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case fromName == "":
+		return fmt.Errorf("flag -from-name is required")
+	case to == "":
+		return fmt.Errorf("flag -to is required")
+	case fromKind != certmanager.IssuerKind && fromKind != certmanager.ClusterIssuerKind:
+		return fmt.Errorf("flag -from-kind must be %s or %s", certmanager.IssuerKind, certmanager.ClusterIssuerKind)
+	}
+
+	ctx := context.Background()
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	var crts certmanager.CertificateList
+	if err := cl.List(ctx, &crts, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("error listing Certificates: %v", err)
+	}
+
+	var found, skipped int
+	var migrations []*migration
+	for i := range crts.Items {
+		crt := &crts.Items[i]
+		if !usesIssuer(crt.Spec.IssuerRef, fromKind, fromName) {
+			continue
+		}
+		found++
+
+		key := types.NamespacedName{Namespace: crt.Namespace, Name: crt.Name}
+		ready, err := isStepIssuerReady(ctx, cl, types.NamespacedName{Namespace: crt.Namespace, Name: to})
+		if err != nil {
+			return err
+		}
+		if !ready {
+			fmt.Printf("%s: skipped, StepIssuer %s/%s not found or not ready\n", key, crt.Namespace, to)
+			skipped++
+			continue
+		}
+
+		fmt.Printf("%s: %s/%s -> StepIssuer/%s\n", key, fromKind, fromName, to)
+		if !apply {
+			continue
+		}
+		m, err := migrate(ctx, cl, crt, fromKind, fromName, to)
+		if err != nil {
+			return fmt.Errorf("error migrating Certificate %s: %v", key, err)
+		}
+		migrations = append(migrations, m)
+	}
+
+	if !apply {
+		fmt.Printf("%d Certificates would be migrated, %d skipped. Use -apply to migrate them.\n", found-skipped, skipped)
+		return nil
+	}
+	fmt.Printf("%d Certificates migrated, %d skipped.\n", len(migrations), skipped)
+
+	if waitReissue && len(migrations) > 0 {
+		return waitForReissuance(ctx, cl, migrations, interval, timeout)
+	}
+	return nil
+}
+
+// usesIssuer returns true if the given reference points to the cert-manager
+// issuer with the given kind and name.
+func usesIssuer(ref cmmeta.ObjectReference, kind, name string) bool {
+	if ref.Group != "" && ref.Group != certmanager.SchemeGroupVersion.Group {
+		return false
+	}
+	refKind := ref.Kind
+	if refKind == "" {
+		refKind = certmanager.IssuerKind
+	}
+	return refKind == kind && ref.Name == name
+}
+
+func isStepIssuerReady(ctx context.Context, cl client.Client, key types.NamespacedName) (bool, error) {
+	var iss api.StepIssuer
+	if err := cl.Get(ctx, key, &iss); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error retrieving StepIssuer %s: %v", key, err)
+	}
+	for _, c := range iss.Status.Conditions {
+		if c.Type == api.ConditionReady && c.Status == api.ConditionTrue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// migrate rewrites the issuerRef of the Certificate to the given StepIssuer,
+// the previous issuer is kept in an annotation so the change can be reverted.
+func migrate(ctx context.Context, cl client.Client, crt *certmanager.Certificate, fromKind, fromName, to string) (*migration, error) {
+	m := &migration{
+		key: types.NamespacedName{Namespace: crt.Namespace, Name: crt.Name},
+	}
+	if crt.Status.Revision != nil {
+		m.revision = *crt.Status.Revision
+	}
+
+	patch := client.MergeFrom(crt.DeepCopy())
+	if crt.Annotations == nil {
+		crt.Annotations = make(map[string]string)
+	}
+	crt.Annotations[api.MigratedFromAnnotationKey] = fromKind + "/" + fromName
+	crt.Spec.IssuerRef = cmmeta.ObjectReference{
+		Name:  to,
+		Kind:  "StepIssuer",
+		Group: api.GroupVersion.Group,
+	}
+	if err := cl.Patch(ctx, crt, patch); err != nil {
+		return nil, err
+	}
+	m.generation = crt.Generation
+	return m, nil
+}
+
+// waitForReissuance polls the migrated Certificates until all of them have a
+// new revision and are ready, printing the progress on every check.
+func waitForReissuance(ctx context.Context, cl client.Client, migrations []*migration, interval, timeout time.Duration) error {
+	var done int
+	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
+		for _, m := range migrations {
+			if m.done {
+				continue
+			}
+			var crt certmanager.Certificate
+			if err := cl.Get(ctx, m.key, &crt); err != nil {
+				if apierrors.IsNotFound(err) {
+					fmt.Printf("%s: deleted\n", m.key)
+					m.done = true
+					done++
+					continue
+				}
+				fmt.Printf("%s: error retrieving Certificate: %v\n", m.key, err)
+				continue
+			}
+			if isReissued(&crt, m) {
+				fmt.Printf("%s: re-issued, revision %d\n", m.key, *crt.Status.Revision)
+				m.done = true
+				done++
+			}
+		}
+		fmt.Printf("%d/%d Certificates re-issued\n", done, len(migrations))
+		return done == len(migrations), nil
+	})
+	if err == wait.ErrWaitTimeout {
+		for _, m := range migrations {
+			if !m.done {
+				fmt.Printf("%s: not re-issued yet\n", m.key)
+			}
+		}
+		return fmt.Errorf("timed out waiting for %d Certificates to be re-issued", len(migrations)-done)
+	}
+	return err
+}
+
+// isReissued returns true if the Certificate has a newer revision than before
+// the migration and it is ready for the migrated generation.
+func isReissued(crt *certmanager.Certificate, m *migration) bool {
+	if crt.Status.Revision == nil || *crt.Status.Revision <= m.revision {
+		return false
+	}
+	for _, c := range crt.Status.Conditions {
+		if c.Type == certmanager.CertificateConditionReady {
+			return c.Status == cmmeta.ConditionTrue && c.ObservedGeneration >= m.generation
+		}
+	}
+	return false
+}
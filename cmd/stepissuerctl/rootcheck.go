@@ -0,0 +1,298 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rootCheck keeps the new roots and the number of problems found while
+// checking the resources of a StepIssuer. Problems are gaps in the trust of
+// the new roots, the certificates that only need to be re-issued after the
+// rotation are counted apart.
+type rootCheck struct {
+	roots    []*x509.Certificate
+	pool     *x509.CertPool
+	problems int
+	reissue  int
+}
+
+func runCheckRoot(args []string) error {
+	var namespace, name, rootFile string
+
+	fs := flag.NewFlagSet("check-root", flag.ExitOnError)
+	fs.StringVar(&namespace, "namespace", "default", "The namespace of the StepIssuer.")
+	fs.StringVar(&name, "issuer", "", "The name of the StepIssuer.")
+	fs.StringVar(&rootFile, "root", "", "The file with the new root certificates in PEM format.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: stepissuerctl check-root -issuer <stepissuer> -root <file> [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Reports what would break if the CA of a StepIssuer was rotated to the given root, without changing anything.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case name == "":
+		return fmt.Errorf("flag -issuer is required")
+	case rootFile == "":
+		return fmt.Errorf("flag -root is required")
+	}
+
+	b, err := ioutil.ReadFile(rootFile)
+	if err != nil {
+		return err
+	}
+	rc, err := newRootCheck(b)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", rootFile, err)
+	}
+	for _, root := range rc.roots {
+		fmt.Printf("New root %s, SHA256 %s\n", root.Subject, fingerprint(root))
+	}
+
+	ctx := context.Background()
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	var iss api.StepIssuer
+	if err := cl.Get(ctx, key, &iss); err != nil {
+		return fmt.Errorf("error retrieving StepIssuer %s: %v", key, err)
+	}
+
+	rc.checkCABundle(&iss)
+	if err := rc.checkClientCertificate(ctx, cl, &iss); err != nil {
+		return err
+	}
+
+	var crts certmanager.CertificateList
+	if err := cl.List(ctx, &crts, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("error listing Certificates: %v", err)
+	}
+	var checked int
+	for i := range crts.Items {
+		crt := &crts.Items[i]
+		if !usesStepIssuer(crt.Spec.IssuerRef, name) {
+			continue
+		}
+		if err := rc.checkCertificate(ctx, cl, crt); err != nil {
+			return err
+		}
+		checked++
+	}
+
+	if rc.reissue > 0 {
+		fmt.Printf("%d certificates will need re-issuance after the rotation.\n", rc.reissue)
+	}
+	if rc.problems > 0 {
+		return fmt.Errorf("%d problems found in StepIssuer %s and its %d Certificates", rc.problems, key, checked)
+	}
+	fmt.Printf("No problems found in StepIssuer %s and its %d Certificates.\n", key, checked)
+	return nil
+}
+
+func newRootCheck(data []byte) (*rootCheck, error) {
+	roots, err := parseCertificates(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	rc := &rootCheck{
+		roots: roots,
+		pool:  x509.NewCertPool(),
+	}
+	for _, root := range roots {
+		if !root.IsCA {
+			return nil, fmt.Errorf("certificate %s is not a CA", root.Subject)
+		}
+		rc.pool.AddCert(root)
+	}
+	return rc, nil
+}
+
+func (rc *rootCheck) report(resource, format string, args ...interface{}) {
+	rc.problems++
+	fmt.Printf("%s: %s\n", resource, fmt.Sprintf(format, args...))
+}
+
+// checkCABundle verifies that the roots pinned in the StepIssuer contain the
+// new roots, otherwise the TLS connections to the CA will fail once it uses a
+// certificate signed by them.
+func (rc *rootCheck) checkCABundle(iss *api.StepIssuer) {
+	resource := fmt.Sprintf("StepIssuer %s/%s", iss.Namespace, iss.Name)
+	if len(iss.Spec.CABundle) == 0 {
+		fmt.Printf("%s: spec.caBundle not set, the system roots are used\n", resource)
+		return
+	}
+	pinned, err := parseCertificates(iss.Spec.CABundle)
+	if err != nil {
+		rc.report(resource, "error parsing spec.caBundle: %v", err)
+		return
+	}
+	for _, root := range rc.roots {
+		if !containsCertificate(pinned, root) {
+			rc.report(resource, "spec.caBundle does not contain the new root %s, connections to the CA will fail", fingerprint(root))
+		}
+	}
+}
+
+// checkClientCertificate checks if the client certificate of the StepIssuer,
+// if any, chains to the new roots.
+func (rc *rootCheck) checkClientCertificate(ctx context.Context, cl client.Client, iss *api.StepIssuer) error {
+	ref := iss.Spec.ClientCertificateRef
+	if ref == nil {
+		return nil
+	}
+	resource := fmt.Sprintf("StepIssuer %s/%s client certificate", iss.Namespace, iss.Name)
+	var secret core.Secret
+	key := types.NamespacedName{Namespace: iss.Namespace, Name: ref.Name}
+	if err := cl.Get(ctx, key, &secret); err != nil {
+		return fmt.Errorf("error retrieving Secret %s: %v", key, err)
+	}
+	rc.checkChain(resource, secret.Data[core.TLSCertKey])
+	return nil
+}
+
+// checkCertificate checks if the chain of the Certificate chains to the new
+// roots, and verifies that the trust bundle in its Secret contains them.
+func (rc *rootCheck) checkCertificate(ctx context.Context, cl client.Client, crt *certmanager.Certificate) error {
+	resource := fmt.Sprintf("Certificate %s/%s", crt.Namespace, crt.Name)
+	var secret core.Secret
+	key := types.NamespacedName{Namespace: crt.Namespace, Name: crt.Spec.SecretName}
+	if err := cl.Get(ctx, key, &secret); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			fmt.Printf("%s: Secret %s not found, skipped\n", resource, key)
+			return nil
+		}
+		return fmt.Errorf("error retrieving Secret %s: %v", key, err)
+	}
+
+	rc.checkChain(resource, secret.Data[core.TLSCertKey])
+
+	caCerts, err := parseCertificates(secret.Data[cmmeta.TLSCAKey])
+	switch {
+	case err != nil:
+		rc.report(resource, "error parsing %s: %v", cmmeta.TLSCAKey, err)
+	case len(caCerts) == 0:
+		fmt.Printf("%s: %s not set\n", resource, cmmeta.TLSCAKey)
+	default:
+		for _, root := range rc.roots {
+			if !containsCertificate(caCerts, root) {
+				rc.report(resource, "%s does not contain the new root %s, clients using it will not trust the re-issued certificates", cmmeta.TLSCAKey, fingerprint(root))
+			}
+		}
+	}
+	return nil
+}
+
+// checkChain checks if the chain in the given PEM data verifies with the new
+// roots. A new root usually has a new key, so the current certificates are
+// expected to fail, they are reported as needing re-issuance instead of as
+// problems. Malformed chains are problems.
+func (rc *rootCheck) checkChain(resource string, data []byte) {
+	chain, err := parseCertificates(data)
+	switch {
+	case err != nil:
+		rc.report(resource, "error parsing %s: %v", core.TLSCertKey, err)
+	case len(chain) == 0:
+		fmt.Printf("%s: %s not set\n", resource, core.TLSCertKey)
+	default:
+		if err := rc.verifyChain(chain); err != nil {
+			rc.reissue++
+			fmt.Printf("%s: the chain does not verify with the new roots, it will need re-issuance after the rotation: %v\n", resource, err)
+		}
+	}
+}
+
+// verifyChain verifies the first certificate in the chain using the rest of
+// certificates as intermediates and the new roots.
+func (rc *rootCheck) verifyChain(chain []*x509.Certificate) error {
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         rc.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// usesStepIssuer returns true if the given reference points to the StepIssuer
+// with the given name.
+func usesStepIssuer(ref cmmeta.ObjectReference, name string) bool {
+	return ref.Group == api.GroupVersion.Group && ref.Kind == "StepIssuer" && ref.Name == name
+}
+
+// parseCertificates returns the certificates in the given PEM data, other
+// blocks are ignored.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func containsCertificate(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate in the hex
+// format used by step.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
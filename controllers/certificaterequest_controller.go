@@ -18,7 +18,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/go-logr/logr"
 	apiutil "github.com/jetstack/cert-manager/pkg/api/util"
@@ -33,7 +36,9 @@ import (
 	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 // CertificateRequestReconciler reconciles a StepIssuer object.
@@ -44,22 +49,57 @@ type CertificateRequestReconciler struct {
 
 	Clock                  clock.Clock
 	CheckApprovedCondition bool
+
+	// StatusUpdateMinInterval is the minimum interval between the status
+	// updates of a pending CertificateRequest that do not change its Ready
+	// condition, it is disabled if it is not positive.
+	StatusUpdateMinInterval time.Duration
+
+	// ExpiryDangerWindow is the time before the expiration of a certificate
+	// in which the signing failures of its renewals are escalated, it is
+	// disabled if it is not positive.
+	ExpiryDangerWindow time.Duration
+
+	throttle *statusThrottle
 }
 
-// +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=cert-manager.io,resources=certificaterequests/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch
 
 // Reconcile will read and validate a StepIssuer resource associated to the
 // CertificateRequest resource, and it will sign the CertificateRequest with the
-// provisioner in the StepIssuer.
+// provisioner in the StepIssuer. It handles the CertificateRequests without the
+// urgent priority annotation.
 func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log := r.Log.WithValues("certificaterequest", req.NamespacedName)
+	return r.reconcile(ctx, req, false)
+}
+
+// urgentReconciler handles the CertificateRequests with the urgent priority
+// annotation in their own queue.
+type urgentReconciler struct {
+	*CertificateRequestReconciler
+}
+
+// Reconcile handles the CertificateRequests with the urgent priority
+// annotation.
+func (r urgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return r.reconcile(ctx, req, true)
+}
+
+// reconcile signs the CertificateRequest if its priority matches the queue.
+// The queues are split by an event predicate, but a request can still be
+// queued in both after its annotation changes, so the annotation is checked
+// again to never sign it twice.
+func (r *CertificateRequestReconciler) reconcile(ctx context.Context, req ctrl.Request, urgent bool) (ctrl.Result, error) {
+	log := r.Log.WithValues("certificaterequest", req.NamespacedName, "urgent", urgent)
 
 	// Fetch the CertificateRequest resource being reconciled.
 	// Just ignore the request if the certificate request has been deleted.
 	cr := new(cmapi.CertificateRequest)
 	if err := r.Client.Get(ctx, req.NamespacedName, cr); err != nil {
 		if apierrors.IsNotFound(err) {
+			r.throttle.forget(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 
@@ -67,6 +107,11 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, err
 	}
 
+	if isUrgent(cr) != urgent {
+		log.V(4).Info("CertificateRequest is handled by the other queue, skipping it")
+		return ctrl.Result{}, nil
+	}
+
 	// Check the CertificateRequest's issuerRef and if it does not match the api
 	// group name, log a message at a debug level and stop processing.
 	if cr.Spec.IssuerRef.Group != "" && cr.Spec.IssuerRef.Group != api.GroupVersion.Group {
@@ -109,6 +154,22 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, nil
 	}
 
+	// Do not sign CertificateRequests that have been replaced by a newer one
+	// for the same Certificate, this is a permanent failure.
+	newer, err := r.supersededBy(ctx, cr)
+	if err != nil {
+		log.Error(err, "failed to list CertificateRequests for the same Certificate")
+		return ctrl.Result{}, err
+	}
+	if newer != nil {
+		log.Info("CertificateRequest has been superseded, skipping it", "newer", newer.Name)
+		if cr.Status.FailureTime == nil {
+			nowTime := metav1.NewTime(r.Clock.Now())
+			cr.Status.FailureTime = &nowTime
+		}
+		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed, "Superseded by CertificateRequest %s with revision %s", newer.Name, newer.Annotations[cmapi.CertificateRequestRevisionAnnotationKey])
+	}
+
 	// Fetch the StepIssuer resource
 	iss := api.StepIssuer{}
 	issNamespaceName := types.NamespacedName{
@@ -129,6 +190,17 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, err
 	}
 
+	// Reject the CertificateRequest if it is not allowed by the StepIssuer
+	// policy, this is a permanent failure.
+	if err := provisioners.CheckPolicy(iss.Spec.Policy, cr); err != nil {
+		log.Error(err, "certificate request rejected by StepIssuer policy")
+		if cr.Status.FailureTime == nil {
+			nowTime := metav1.NewTime(r.Clock.Now())
+			cr.Status.FailureTime = &nowTime
+		}
+		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed, "Certificate request rejected by StepIssuer policy: %v", err)
+	}
+
 	// Load the provisioner that will sign the CertificateRequest
 	provisioner, ok := provisioners.Load(issNamespaceName)
 	if !ok {
@@ -142,6 +214,18 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 	signedPEM, trustedCAs, err := provisioner.Sign(ctx, cr)
 	if err != nil {
 		log.Error(err, "failed to sign certificate request")
+		// In FIPS mode the CertificateRequests using algorithms that are not
+		// FIPS approved are rejected, this is a permanent failure.
+		if errors.As(err, new(*provisioners.FIPSError)) {
+			if cr.Status.FailureTime == nil {
+				nowTime := metav1.NewTime(r.Clock.Now())
+				cr.Status.FailureTime = &nowTime
+			}
+			return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed, "Certificate request rejected in FIPS mode: %v", err)
+		}
+		if crt := r.expiringCertificate(ctx, cr); crt != nil {
+			return r.handleExpiring(ctx, log, cr, crt, &iss, err)
+		}
 		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed, "Failed to sign certificate request: %v", err)
 	}
 	cr.Status.Certificate = signedPEM
@@ -152,12 +236,72 @@ func (r *CertificateRequestReconciler) Reconcile(ctx context.Context, req ctrl.R
 
 // SetupWithManager initializes the CertificateRequest controller into the
 // controller runtime.
+//
+// CertificateRequests with the urgent priority annotation are handled by a
+// second controller with its own queue, so they are signed without waiting for
+// the rest of the requests.
 func (r *CertificateRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.throttle = newStatusThrottle(r.Clock, r.StatusUpdateMinInterval)
+
+	if err := ctrl.NewControllerManagedBy(mgr).
+		Named("certificaterequest_urgent").
+		For(&cmapi.CertificateRequest{}, builder.WithPredicates(predicate.NewPredicateFuncs(isUrgent))).
+		Complete(urgentReconciler{r}); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&cmapi.CertificateRequest{}).
+		For(&cmapi.CertificateRequest{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return !isUrgent(obj)
+		}))).
 		Complete(r)
 }
 
+// isUrgent returns true if the given object has the urgent priority
+// annotation.
+func isUrgent(obj client.Object) bool {
+	return obj.GetAnnotations()[api.PriorityAnnotationKey] == api.PriorityUrgent
+}
+
+// supersededBy returns a CertificateRequest for the same Certificate that
+// replaces the given one, either because it has a greater revision, or because
+// it has the same revision and has been created later. It returns nil if the
+// CertificateRequest is not owned by a Certificate or is the most recent one.
+//
+// The CertificateRequests of the namespace are filtered in memory instead of
+// using a field index: the controller can be set up after the manager has
+// started, when the cert-manager resources become available, and indexes
+// cannot be added to an informer that has already started.
+func (r *CertificateRequestReconciler) supersededBy(ctx context.Context, cr *cmapi.CertificateRequest) (*cmapi.CertificateRequest, error) {
+	name, ok := cr.Annotations[cmapi.CertificateNameKey]
+	if !ok {
+		return nil, nil
+	}
+	revision, err := strconv.Atoi(cr.Annotations[cmapi.CertificateRequestRevisionAnnotationKey])
+	if err != nil {
+		return nil, nil
+	}
+
+	var list cmapi.CertificateRequestList
+	if err := r.Client.List(ctx, &list, client.InNamespace(cr.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		other := &list.Items[i]
+		if other.UID == cr.UID || other.DeletionTimestamp != nil || other.Annotations[cmapi.CertificateNameKey] != name {
+			continue
+		}
+		otherRevision, err := strconv.Atoi(other.Annotations[cmapi.CertificateRequestRevisionAnnotationKey])
+		if err != nil {
+			continue
+		}
+		if otherRevision > revision || (otherRevision == revision && cr.CreationTimestamp.Before(&other.CreationTimestamp)) {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
 // stepIssuerHasCondition will return true if the given StepIssuer resource has
 // a condition matching the provided StepIssuerCondition. Only the Type and
 // Status field will be used in the comparison, meaning that this function will
@@ -173,7 +317,26 @@ func stepIssuerHasCondition(iss api.StepIssuer, c api.StepIssuerCondition) bool
 	return false
 }
 
+// setStatus sets the Ready condition of the CertificateRequest and updates its
+// status. Pending CertificateRequests are retried with backoff, so the updates
+// that do not change their condition are rate-limited to
+// StatusUpdateMinInterval.
 func (r *CertificateRequestReconciler) setStatus(ctx context.Context, cr *cmapi.CertificateRequest, status cmmeta.ConditionStatus, reason, message string, args ...interface{}) error {
+	changed := true
+	for _, c := range cr.Status.Conditions {
+		if c.Type == cmapi.CertificateRequestConditionReady {
+			changed = c.Status != status || c.Reason != reason
+		}
+	}
+
+	key := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	if reason != cmapi.CertificateRequestReasonPending {
+		r.throttle.forget(key)
+	} else if !r.throttle.allow(key, changed) {
+		r.Log.V(4).Info("skipping unchanged status update", "certificaterequest", key, "reason", reason)
+		return nil
+	}
+
 	completeMessage := fmt.Sprintf(message, args...)
 	apiutil.SetCertificateRequestCondition(cr, cmapi.CertificateRequestConditionReady, status, reason, completeMessage)
 
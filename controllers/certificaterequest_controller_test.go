@@ -0,0 +1,159 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := cmapi.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newDeniedCertificateRequest returns a denied CertificateRequest, the
+// reconciler marks it as denied without contacting any CA.
+func newDeniedCertificateRequest(annotations map[string]string) *cmapi.CertificateRequest {
+	return &cmapi.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "test",
+			Annotations: annotations,
+		},
+		Spec: cmapi.CertificateRequestSpec{
+			IssuerRef: cmmeta.ObjectReference{
+				Name:  "step-issuer",
+				Kind:  "StepIssuer",
+				Group: api.GroupVersion.Group,
+			},
+		},
+		Status: cmapi.CertificateRequestStatus{
+			Conditions: []cmapi.CertificateRequestCondition{{
+				Type:   cmapi.CertificateRequestConditionDenied,
+				Status: cmmeta.ConditionTrue,
+			}},
+		},
+	}
+}
+
+func TestCertificateRequestReconcilerQueues(t *testing.T) {
+	urgent := map[string]string{api.PriorityAnnotationKey: api.PriorityUrgent}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		urgentQueue bool
+		wantHandled bool
+	}{
+		{"regular in regular queue", nil, false, true},
+		{"regular in urgent queue", nil, true, false},
+		{"urgent in urgent queue", urgent, true, true},
+		{"urgent in regular queue", urgent, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := newDeniedCertificateRequest(tt.annotations)
+			cl := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(cr).Build()
+			r := &CertificateRequestReconciler{
+				Client:   cl,
+				Log:      logf.Log,
+				Recorder: record.NewFakeRecorder(10),
+				Clock:    clock.RealClock{},
+			}
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test"}}
+			var err error
+			if tt.urgentQueue {
+				_, err = urgentReconciler{r}.Reconcile(context.Background(), req)
+			} else {
+				_, err = r.Reconcile(context.Background(), req)
+			}
+			if err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+
+			got := new(cmapi.CertificateRequest)
+			if err := cl.Get(context.Background(), client.ObjectKeyFromObject(cr), got); err != nil {
+				t.Fatal(err)
+			}
+			handled := got.Status.FailureTime != nil
+			if handled != tt.wantHandled {
+				t.Errorf("CertificateRequest handled = %v, want %v", handled, tt.wantHandled)
+			}
+		})
+	}
+}
+
+func TestCertificateRequestReconcilerPriorityFlip(t *testing.T) {
+	cr := newDeniedCertificateRequest(nil)
+	cl := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(cr).Build()
+	r := &CertificateRequestReconciler{
+		Client:   cl,
+		Log:      logf.Log,
+		Recorder: record.NewFakeRecorder(10),
+		Clock:    clock.RealClock{},
+	}
+
+	// The request is annotated as urgent while it is still queued in the
+	// regular queue, only the urgent queue must handle it.
+	patch := client.MergeFrom(cr.DeepCopy())
+	cr.Annotations = map[string]string{api.PriorityAnnotationKey: api.PriorityUrgent}
+	if err := cl.Patch(context.Background(), cr, patch); err != nil {
+		t.Fatal(err)
+	}
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cr)}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	got := new(cmapi.CertificateRequest)
+	if err := cl.Get(context.Background(), req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.FailureTime != nil {
+		t.Fatal("regular queue handled an urgent CertificateRequest")
+	}
+
+	if _, err := (urgentReconciler{r}).Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if err := cl.Get(context.Background(), req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.FailureTime == nil {
+		t.Fatal("urgent queue did not handle the CertificateRequest")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// certManagerAvailable reports whether the cert-manager CertificateRequest
+// resource is served by the API server.
+var certManagerAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "step_issuer_certmanager_crds_available",
+	Help: "Whether the cert-manager CertificateRequest resource is available, 1 if it is and 0 if it is not.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(certManagerAvailable)
+}
+
+// CertManagerWaiter waits until the cert-manager CertificateRequest resource
+// is served by the API server and then calls Setup, usually to add the
+// controllers that watch cert-manager resources. It allows to install
+// step-issuer before cert-manager without crash-looping.
+//
+// The availability of the resource is checked with an exponential backoff, and
+// it is exposed in the step_issuer_certmanager_crds_available metric.
+type CertManagerWaiter struct {
+	Discovery discovery.DiscoveryInterface
+	Log       logr.Logger
+	Setup     func() error
+
+	// Backoff is the backoff between checks, by default it starts at 5s and
+	// it is capped at 5m.
+	Backoff *wait.Backoff
+}
+
+// Start waits for the cert-manager resources and calls Setup, it returns
+// without calling it if the given context is done first.
+func (w *CertManagerWaiter) Start(ctx context.Context) error {
+	backoff := wait.Backoff{
+		Duration: 5 * time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    1 << 30,
+		Cap:      5 * time.Minute,
+	}
+	if w.Backoff != nil {
+		backoff = *w.Backoff
+	}
+
+	for {
+		ok, err := w.available()
+		switch {
+		case err != nil:
+			w.Log.Error(err, "failed to check cert-manager CertificateRequest resource")
+		case ok:
+			certManagerAvailable.Set(1)
+			w.Log.Info("cert-manager CertificateRequest resource available")
+			return w.Setup()
+		default:
+			certManagerAvailable.Set(0)
+			w.Log.Info("cert-manager CertificateRequest resource not found, is cert-manager installed?")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// SetupWithManager adds the waiter to the controller runtime.
+func (w *CertManagerWaiter) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(w)
+}
+
+func (w *CertManagerWaiter) available() (bool, error) {
+	resources, err := w.Discovery.ServerResourcesForGroupVersion(cmapi.SchemeGroupVersion.String())
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Kind == cmapi.CertificateRequestKind {
+			return true, nil
+		}
+	}
+	return false, nil
+}
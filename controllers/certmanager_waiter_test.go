@@ -0,0 +1,146 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// certificateRequestCRD returns a minimal cert-manager CertificateRequest CRD
+// that accepts any object.
+func certificateRequestCRD() *apiextensionsv1.CustomResourceDefinition {
+	preserveUnknownFields := true
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "certificaterequests." + cmapi.SchemeGroupVersion.Group},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: cmapi.SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   "certificaterequests",
+				Singular: "certificaterequest",
+				Kind:     cmapi.CertificateRequestKind,
+				ListKind: cmapi.CertificateRequestKind + "List",
+			},
+			Scope: apiextensionsv1.NamespaceScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{{
+				Name:    cmapi.SchemeGroupVersion.Version,
+				Served:  true,
+				Storage: true,
+				Schema: &apiextensionsv1.CustomResourceValidation{
+					OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+						Type:                   "object",
+						XPreserveUnknownFields: &preserveUnknownFields,
+					},
+				},
+				Subresources: &apiextensionsv1.CustomResourceSubresources{
+					Status: &apiextensionsv1.CustomResourceSubresourceStatus{},
+				},
+			}},
+		},
+	}
+}
+
+var _ = Describe("CertManagerWaiter", func() {
+	It("sets up the CertificateRequest controller after the manager has started", func() {
+		Expect(cmapi.AddToScheme(scheme.Scheme)).To(Succeed())
+		Expect(apiextensionsv1.AddToScheme(scheme.Scheme)).To(Succeed())
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme.Scheme,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		setupErrs := make(chan error, 1)
+		waiter := &CertManagerWaiter{
+			Discovery: discovery.NewDiscoveryClientForConfigOrDie(cfg),
+			Log:       ctrl.Log.WithName("cert-manager"),
+			Setup: func() error {
+				err := (&CertificateRequestReconciler{
+					Client:   mgr.GetClient(),
+					Log:      ctrl.Log.WithName("controllers").WithName("CertificateRequest"),
+					Recorder: mgr.GetEventRecorderFor("step-issuer"),
+					Clock:    clock.RealClock{},
+				}).SetupWithManager(mgr)
+				setupErrs <- err
+				return err
+			},
+			Backoff: &wait.Backoff{Duration: 100 * time.Millisecond, Factor: 1, Steps: 1 << 30},
+		}
+		Expect(waiter.SetupWithManager(mgr)).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mgrErrs := make(chan error, 1)
+		go func() {
+			mgrErrs <- mgr.Start(ctx)
+		}()
+
+		By("waiting without the cert-manager CRDs")
+		Consistently(setupErrs, time.Second).ShouldNot(Receive())
+
+		By("installing the CertificateRequest CRD")
+		crd := certificateRequestCRD()
+		Expect(k8sClient.Create(context.Background(), crd)).To(Succeed())
+		defer func() {
+			cancel()
+			Expect(k8sClient.Delete(context.Background(), crd)).To(Succeed())
+		}()
+
+		var setupErr error
+		Eventually(setupErrs, 10*time.Second).Should(Receive(&setupErr))
+		Expect(setupErr).ToNot(HaveOccurred())
+
+		By("reconciling a denied CertificateRequest")
+		cr := newDeniedCertificateRequest(nil)
+		cr.Name = "waiter-test"
+		status := cr.Status
+		Expect(k8sClient.Create(context.Background(), cr)).To(Succeed())
+		cr.Status = status
+		Expect(k8sClient.Status().Update(context.Background(), cr)).To(Succeed())
+
+		Eventually(func() bool {
+			got := new(cmapi.CertificateRequest)
+			if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(cr), got); err != nil {
+				return false
+			}
+			for _, c := range got.Status.Conditions {
+				if c.Type == cmapi.CertificateRequestConditionReady && c.Status == cmmeta.ConditionFalse && c.Reason == cmapi.CertificateRequestReasonDenied {
+					return true
+				}
+			}
+			return false
+		}, 10*time.Second).Should(BeTrue())
+		Consistently(mgrErrs, time.Second).ShouldNot(Receive())
+
+		cancel()
+		Eventually(mgrErrs, 10*time.Second).Should(Receive(BeNil()))
+	})
+})
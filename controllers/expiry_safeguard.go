@@ -0,0 +1,137 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/provisioners"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// reasonExpiringSoon is the reason of the Events emitted when the renewal of
+// a certificate about to expire fails.
+const reasonExpiringSoon = "ExpiringSoon"
+
+// expiringSigningFailures counts the signing failures of renewals of
+// certificates inside the expiry danger window. It is labeled by StepIssuer,
+// the certificate is only reported in the events, so the number of series
+// does not grow with the number of certificates.
+var expiringSigningFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "step_issuer_expiring_certificate_signing_failures_total",
+	Help: "Number of signing failures of renewals of certificates about to expire.",
+}, []string{"namespace", "issuer"})
+
+func init() {
+	metrics.Registry.MustRegister(expiringSigningFailures)
+}
+
+// expiringCertificate returns the Certificate that owns the given
+// CertificateRequest if its current certificate expires within
+// ExpiryDangerWindow. It returns nil if the safeguard is disabled, the
+// CertificateRequest is not a renewal or there is enough time left.
+func (r *CertificateRequestReconciler) expiringCertificate(ctx context.Context, cr *cmapi.CertificateRequest) *cmapi.Certificate {
+	if r.ExpiryDangerWindow <= 0 {
+		return nil
+	}
+	name, ok := cr.Annotations[cmapi.CertificateNameKey]
+	if !ok {
+		return nil
+	}
+	crt := new(cmapi.Certificate)
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: name}, crt); err != nil {
+		return nil
+	}
+	if crt.Status.NotAfter == nil || crt.Status.NotAfter.Sub(r.Clock.Now()) > r.ExpiryDangerWindow {
+		return nil
+	}
+	return crt
+}
+
+// handleExpiring escalates a signing failure of a CertificateRequest renewing
+// a certificate about to expire. It emits a critical Event and metric, and
+// signs the request with the fallback StepIssuer if there is one. Otherwise the
+// CertificateRequest is kept pending instead of failed, and it is moved to the
+// urgent queue to be retried with backoff.
+func (r *CertificateRequestReconciler) handleExpiring(ctx context.Context, log logr.Logger, cr *cmapi.CertificateRequest, crt *cmapi.Certificate, iss *api.StepIssuer, signErr error) (ctrl.Result, error) {
+	message := fmt.Sprintf("Certificate %s expires at %s and its renewal failed: %v", crt.Name, crt.Status.NotAfter.Format(time.RFC3339), signErr)
+	log.Info("renewal of certificate about to expire failed", "certificate", crt.Name, "notAfter", crt.Status.NotAfter)
+	expiringSigningFailures.WithLabelValues(iss.Namespace, iss.Name).Inc()
+	r.Recorder.Event(crt, core.EventTypeWarning, reasonExpiringSoon, message)
+	r.Recorder.Event(cr, core.EventTypeWarning, reasonExpiringSoon, message)
+
+	if iss.Spec.FallbackIssuerName != "" {
+		signedPEM, trustedCAs, err := r.signWithFallback(ctx, cr, iss)
+		if err == nil {
+			cr.Status.Certificate = signedPEM
+			cr.Status.CA = trustedCAs
+			return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionTrue, cmapi.CertificateRequestReasonIssued, "Certificate issued by fallback StepIssuer %s", iss.Spec.FallbackIssuerName)
+		}
+		log.Error(err, "failed to sign certificate request with fallback StepIssuer", "fallback", iss.Spec.FallbackIssuerName)
+		message = fmt.Sprintf("%s, fallback StepIssuer %s failed: %v", message, iss.Spec.FallbackIssuerName, err)
+	}
+
+	// The urgent controller will retry the CertificateRequest once the
+	// annotation is set, only one of the controllers must handle it.
+	if !isUrgent(cr) {
+		patch := client.MergeFrom(cr.DeepCopy())
+		if cr.Annotations == nil {
+			cr.Annotations = make(map[string]string)
+		}
+		cr.Annotations[api.PriorityAnnotationKey] = api.PriorityUrgent
+		if err := r.Client.Patch(ctx, cr, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "%s", message)
+	}
+
+	if err := r.setStatus(ctx, cr, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending, "%s", message); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, signErr
+}
+
+// signWithFallback signs the CertificateRequest with the fallback StepIssuer of
+// the given one, applying the policy of the fallback.
+func (r *CertificateRequestReconciler) signWithFallback(ctx context.Context, cr *cmapi.CertificateRequest, iss *api.StepIssuer) ([]byte, []byte, error) {
+	key := types.NamespacedName{Namespace: iss.Namespace, Name: iss.Spec.FallbackIssuerName}
+	var fallback api.StepIssuer
+	if err := r.Client.Get(ctx, key, &fallback); err != nil {
+		return nil, nil, err
+	}
+	if !stepIssuerHasCondition(fallback, api.StepIssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
+		return nil, nil, fmt.Errorf("resource %s is not ready", key)
+	}
+	if err := provisioners.CheckPolicy(fallback.Spec.Policy, cr); err != nil {
+		return nil, nil, err
+	}
+	provisioner, ok := provisioners.Load(key)
+	if !ok {
+		return nil, nil, fmt.Errorf("provisioner %s not found", key)
+	}
+	return provisioner.Sign(ctx, cr)
+}
@@ -0,0 +1,72 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+)
+
+// statusThrottle limits the rate of the status updates that do not change the
+// status or the reason of a condition, like the ones written on every retry of
+// a transient failure. Updates changing the condition are always allowed.
+type statusThrottle struct {
+	clock    clock.Clock
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[types.NamespacedName]time.Time
+}
+
+func newStatusThrottle(clk clock.Clock, interval time.Duration) *statusThrottle {
+	return &statusThrottle{
+		clock:    clk,
+		interval: interval,
+		last:     make(map[types.NamespacedName]time.Time),
+	}
+}
+
+// allow returns true if the status of the given object can be updated, and
+// records the time of the update if it is.
+func (t *statusThrottle) allow(key types.NamespacedName, changed bool) bool {
+	if t == nil || t.interval <= 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	if last, ok := t.last[key]; ok && !changed && now.Sub(last) < t.interval {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
+
+// forget removes the given object, it must be called once the object reaches
+// a final state or it is deleted.
+func (t *statusThrottle) forget(key types.NamespacedName) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.last, key)
+	t.mu.Unlock()
+}
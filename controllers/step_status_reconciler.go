@@ -38,6 +38,12 @@ func (r *stepStatusReconciler) Update(ctx context.Context, status api.ConditionS
 	return r.Client.Status().Update(ctx, r.issuer)
 }
 
+// UpdateStatus updates the status of the StepIssuer without changing its
+// conditions.
+func (r *stepStatusReconciler) UpdateStatus(ctx context.Context) error {
+	return r.Client.Status().Update(ctx, r.issuer)
+}
+
 func (r *stepStatusReconciler) UpdateNoError(ctx context.Context, status api.ConditionStatus, reason, message string, args ...interface{}) {
 	if err := r.Update(ctx, status, reason, message, args...); err != nil {
 		r.logger.Error(err, "failed to update", "status", status, "reason", reason)
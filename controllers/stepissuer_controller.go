@@ -17,18 +17,27 @@ package controllers
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-logr/logr"
 	api "github.com/smallstep/step-issuer/api/v1beta1"
 	"github.com/smallstep/step-issuer/provisioners"
 	core "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // StepIssuerReconciler reconciles a StepIssuer object
@@ -37,6 +46,28 @@ type StepIssuerReconciler struct {
 	Log      logr.Logger
 	Clock    clock.Clock
 	Recorder record.EventRecorder
+
+	// ProvisionerClock is the clock of the provisioners, used to create the
+	// tokens and to backdate certificates. It can be skewed to match the clock
+	// of the CA. The system clock is used if it is not set.
+	ProvisionerClock clock.Clock
+
+	// ProbeInterval is the interval at which the CA of ready StepIssuers is
+	// probed, probes are disabled if it is not positive.
+	ProbeInterval time.Duration
+
+	// SecretReader is used to read the provisioner passwords and client
+	// certificates, an uncached reader avoids keeping every secret in the
+	// informer cache. The Client is used if it is not set.
+	SecretReader client.Reader
+
+	// OnDemandKeys disables keeping the decrypted provisioner keys in memory,
+	// the passwords are read and the keys decrypted every time a certificate
+	// is signed.
+	OnDemandKeys bool
+
+	// FIPS creates the provisioners in FIPS mode, see provisioners.WithFIPS.
+	FIPS bool
 }
 
 // +kubebuilder:rbac:groups=certmanager.step.sm,resources=stepissuers,verbs=get;list;watch;create;update;patch;delete
@@ -47,66 +78,369 @@ type StepIssuerReconciler struct {
 
 // Reconcile will read and validate the StepIssuer resources, it will set the
 // status condition ready to true if everything is right.
+//
+// Ready StepIssuers are reconciled every ProbeInterval to check the health of
+// the CA and report the latency of the recent requests in the status.
 func (r *StepIssuerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("stepissuer", req.NamespacedName)
 
 	iss := new(api.StepIssuer)
 	if err := r.Client.Get(ctx, req.NamespacedName, iss); err != nil {
+		// The StepIssuer has been deleted, release its provisioner.
+		if apierrors.IsNotFound(err) {
+			log.V(4).Info("StepIssuer resource not found, removing provisioner")
+			provisioners.Delete(req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+
 		log.Error(err, "failed to retrieve StepIssuer resource")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return ctrl.Result{}, err
 	}
 
 	statusReconciler := newStepStatusReconciler(r, iss, log)
 	if err := validateStepIssuerSpec(iss.Spec); err != nil {
 		log.Error(err, "failed to validate StepIssuer resource")
+		provisioners.Delete(req.NamespacedName)
 		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Validation", "Failed to validate resource: %v", err)
 		return ctrl.Result{}, err
 	}
 
-	// Fetch the provisioner password
-	var secret core.Secret
-	secretNamespaceName := types.NamespacedName{
-		Namespace: req.Namespace,
-		Name:      iss.Spec.Provisioner.PasswordRef.Name,
+	versions, err := r.secretVersions(ctx, iss)
+	if err != nil {
+		log.Error(err, "failed to retrieve StepIssuer secrets")
+		return ctrl.Result{}, err
 	}
-	if err := r.Client.Get(ctx, secretNamespaceName, &secret); err != nil {
-		log.Error(err, "failed to retrieve StepIssuer provisioner secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		if apierrors.IsNotFound(err) {
+
+	// Reuse the provisioner if the StepIssuer and its secrets have not
+	// changed, in that case the CA is just probed. Changes in the policy do
+	// not require a new provisioner, it is read from the StepIssuer on every
+	// signing. The Ready condition is set again in case a previous update
+	// failed.
+	p, ok := provisioners.Load(req.NamespacedName)
+	if ok && p.Matches(iss, versions) {
+		r.probe(p, iss, log)
+		if !stepIssuerHasCondition(*iss, api.StepIssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue}) {
+			return r.result(), statusReconciler.Update(ctx, api.ConditionTrue, "Verified", "StepIssuer verified and ready to sign certificates")
+		}
+		return r.result(), statusReconciler.UpdateStatus(ctx)
+	}
+
+	// Initialize and store the provisioner, the previous one is removed on
+	// errors so it is not reused if the StepIssuer is reverted.
+	p, err = r.newProvisioner(ctx, iss, versions, statusReconciler)
+	if err != nil {
+		provisioners.Delete(req.NamespacedName)
+		return ctrl.Result{}, err
+	}
+	provisioners.Store(req.NamespacedName, p)
+
+	r.probe(p, iss, log)
+	return r.result(), statusReconciler.Update(ctx, api.ConditionTrue, "Verified", "StepIssuer verified and ready to sign certificates")
+}
+
+// newProvisioner fetches the secrets referenced by the StepIssuer and returns
+// a new provisioner, the given secret versions are stored in it. On errors the
+// Ready condition of the StepIssuer will be updated.
+func (r *StepIssuerReconciler) newProvisioner(ctx context.Context, iss *api.StepIssuer, versions map[string]string, statusReconciler *stepStatusReconciler) (*provisioners.Step, error) {
+	log := statusReconciler.logger
+
+	// Fetch the provisioner password, with OnDemandKeys the provisioner
+	// reads it when it is created.
+	var password []byte
+	if !r.OnDemandKeys {
+		var err error
+		if password, err = r.getPassword(ctx, iss.Namespace, iss.Spec.Provisioner.PasswordRef, statusReconciler); err != nil {
+			return nil, err
+		}
+		defer provisioners.Zero(password)
+	}
+
+	// Fetch the client certificate used to authenticate to the CA
+	var identity *tls.Certificate
+	if ref := iss.Spec.ClientCertificateRef; ref != nil {
+		var secret core.Secret
+		secretNamespaceName := types.NamespacedName{
+			Namespace: iss.Namespace,
+			Name:      ref.Name,
+		}
+		if err := r.secretReader().Get(ctx, secretNamespaceName, &secret); err != nil {
+			log.Error(err, "failed to retrieve StepIssuer client certificate secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
+			if apierrors.IsNotFound(err) {
+				statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve client certificate secret: %v", err)
+			} else {
+				statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "Failed to retrieve client certificate secret: %v", err)
+			}
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(secret.Data[core.TLSCertKey], secret.Data[core.TLSPrivateKeyKey])
+		provisioners.Zero(secret.Data[core.TLSPrivateKeyKey])
+		if err != nil {
+			log.Error(err, "failed to load StepIssuer client certificate", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
+			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "Failed to load client certificate from secret %s: %v", secret.Name, err)
+			return nil, err
+		}
+		identity = &cert
+	}
+
+	opts := []provisioners.Option{
+		provisioners.WithIdentity(identity),
+		provisioners.WithClock(r.ProvisionerClock),
+		provisioners.WithLogger(log),
+		provisioners.WithSecretVersions(versions),
+	}
+	if r.OnDemandKeys {
+		opts = append(opts, provisioners.WithOnDemandKeys())
+	}
+	if r.FIPS {
+		opts = append(opts, provisioners.WithFIPS())
+	}
+	p, err := provisioners.NewWithOptions(iss, r.passwordFunc(iss.Namespace, iss.Spec.Provisioner.PasswordRef, password), opts...)
+	if err != nil {
+		log.Error(err, "failed to initialize provisioner")
+		if isSecretNotFound(err) {
+			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve provisioner secret: %v", err)
+		} else {
+			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "failed initialize provisioner")
+		}
+		return nil, err
+	}
+
+	// Initialize the provisioners of the profiles
+	for _, profile := range iss.Spec.Profiles {
+		var password []byte
+		if !r.OnDemandKeys {
+			if password, err = r.getPassword(ctx, iss.Namespace, profile.Provisioner.PasswordRef, statusReconciler); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+		err = p.AddProfile(profile.Name, profile.Provisioner, r.passwordFunc(iss.Namespace, profile.Provisioner.PasswordRef, password))
+		provisioners.Zero(password)
+		if err != nil {
+			log.Error(err, "failed to initialize profile provisioner", "profile", profile.Name)
+			if isSecretNotFound(err) {
+				statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve provisioner secret for profile %s: %v", profile.Name, err)
+			} else {
+				statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "failed initialize provisioner for profile %s", profile.Name)
+			}
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// getPassword returns the provisioner password in the secret referenced by the
+// given selector. On errors the Ready condition of the StepIssuer will be
+// updated. The caller should zero the password once it is no longer needed.
+func (r *StepIssuerReconciler) getPassword(ctx context.Context, namespace string, ref api.SecretKeySelector, statusReconciler *stepStatusReconciler) ([]byte, error) {
+	log := statusReconciler.logger
+
+	password, err := readPassword(ctx, r.secretReader(), namespace, ref)
+	if err != nil {
+		log.Error(err, "failed to retrieve StepIssuer provisioner secret", "namespace", namespace, "name", ref.Name)
+		if isSecretNotFound(err) {
 			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve provisioner secret: %v", err)
 		} else {
 			statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "Failed to retrieve provisioner secret: %v", err)
 		}
-		return ctrl.Result{}, err
+		return nil, err
+	}
+	return password, nil
+}
+
+// passwordReadTimeout bounds the reads of the provisioner passwords done by
+// the provisioners with OnDemandKeys.
+const passwordReadTimeout = 10 * time.Second
+
+// passwordFunc returns the function used by a provisioner to get its password.
+// With OnDemandKeys the password is read from the secret every time and the
+// given password is ignored, otherwise a copy of the given password is used.
+func (r *StepIssuerReconciler) passwordFunc(namespace string, ref api.SecretKeySelector, password []byte) provisioners.PasswordFunc {
+	if !r.OnDemandKeys {
+		return provisioners.StaticPassword(password)
+	}
+	reader := r.secretReader()
+	return func() ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), passwordReadTimeout)
+		defer cancel()
+		return readPassword(ctx, reader, namespace, ref)
+	}
+}
+
+// secretNames returns the names of the secrets referenced by the StepIssuer.
+func secretNames(iss *api.StepIssuer) []string {
+	names := []string{iss.Spec.Provisioner.PasswordRef.Name}
+	for _, profile := range iss.Spec.Profiles {
+		names = append(names, profile.Provisioner.PasswordRef.Name)
+	}
+	if ref := iss.Spec.ClientCertificateRef; ref != nil {
+		names = append(names, ref.Name)
+	}
+	return names
+}
+
+// secretVersions returns the resource versions of the secrets referenced by
+// the StepIssuer, indexed by name. Only the metadata of the secrets is read,
+// the version of a missing secret is empty.
+func (r *StepIssuerReconciler) secretVersions(ctx context.Context, iss *api.StepIssuer) (map[string]string, error) {
+	versions := make(map[string]string)
+	for _, name := range secretNames(iss) {
+		secret := new(meta.PartialObjectMetadata)
+		secret.SetGroupVersionKind(core.SchemeGroupVersion.WithKind("Secret"))
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: iss.Namespace, Name: name}, secret)
+		switch {
+		case apierrors.IsNotFound(err):
+			versions[name] = ""
+		case err != nil:
+			return nil, err
+		default:
+			versions[name] = secret.ResourceVersion
+		}
+	}
+	return versions, nil
+}
+
+// stepIssuersForSecret returns a request for every StepIssuer that references
+// the given secret.
+func (r *StepIssuerReconciler) stepIssuersForSecret(obj client.Object) []reconcile.Request {
+	var list api.StepIssuerList
+	if err := r.Client.List(context.Background(), &list, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "failed to list StepIssuers", "namespace", obj.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range list.Items {
+		for _, name := range secretNames(&list.Items[i]) {
+			if name == obj.GetName() {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: list.Items[i].Namespace, Name: list.Items[i].Name},
+				})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+func (r *StepIssuerReconciler) secretReader() client.Reader {
+	if r.SecretReader != nil {
+		return r.SecretReader
+	}
+	return r.Client
+}
+
+// keyNotFoundError is returned when a secret does not contain the referenced
+// key.
+type keyNotFoundError struct {
+	secret, key string
+}
+
+func (e *keyNotFoundError) Error() string {
+	return fmt.Sprintf("secret %s does not contain key %s", e.secret, e.key)
+}
+
+// isSecretNotFound returns true if the error is caused by a missing secret or
+// by a missing key in it.
+func isSecretNotFound(err error) bool {
+	return apierrors.IsNotFound(err) || errors.As(err, new(*keyNotFoundError))
+}
+
+// readPassword returns the password in the secret referenced by the given
+// selector. The rest of the secret data is zeroed.
+func readPassword(ctx context.Context, reader client.Reader, namespace string, ref api.SecretKeySelector) ([]byte, error) {
+	var secret core.Secret
+	secretNamespaceName := types.NamespacedName{
+		Namespace: namespace,
+		Name:      ref.Name,
+	}
+	if err := reader.Get(ctx, secretNamespaceName, &secret); err != nil {
+		return nil, err
+	}
+	password, ok := secret.Data[ref.Key]
+	for k, v := range secret.Data {
+		if k != ref.Key {
+			provisioners.Zero(v)
+		}
 	}
-	password, ok := secret.Data[iss.Spec.Provisioner.PasswordRef.Key]
 	if !ok {
-		err := fmt.Errorf("secret %s does not contain key %s", secret.Name, iss.Spec.Provisioner.PasswordRef.Key)
-		log.Error(err, "failed to retrieve StepIssuer provisioner secret", "namespace", secretNamespaceName.Namespace, "name", secretNamespaceName.Name)
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "NotFound", "Failed to retrieve provisioner secret: %v", err)
-		return ctrl.Result{}, err
+		return nil, &keyNotFoundError{secret: secret.Name, key: ref.Key}
 	}
+	return password, nil
+}
 
-	// Initialize and store the provisioner
-	p, err := provisioners.New(iss, password)
-	if err != nil {
-		log.Error(err, "failed to initialize provisioner")
-		statusReconciler.UpdateNoError(ctx, api.ConditionFalse, "Error", "failed initialize provisioner")
-		return ctrl.Result{}, err
+// probe checks the health of the CA and sets the CA status of the StepIssuer
+// with the stats of the provisioner. It does nothing if probes are disabled.
+func (r *StepIssuerReconciler) probe(p *provisioners.Step, iss *api.StepIssuer, log logr.Logger) {
+	if r.ProbeInterval <= 0 {
+		return
 	}
-	provisioners.Store(req.NamespacedName, p)
 
-	return ctrl.Result{}, statusReconciler.Update(ctx, api.ConditionTrue, "Verified", "StepIssuer verified and ready to sign certificates")
+	if err := p.Probe(); err != nil {
+		log.Error(err, "failed to probe CA")
+	}
+
+	stats := p.Stats()
+	lastProbeTime := meta.NewTime(stats.LastProbeTime)
+	status := &api.StepCAStatus{
+		LastProbeTime:    &lastProbeTime,
+		LastProbeLatency: &meta.Duration{Duration: stats.LastProbeLatency},
+		LastProbeResult:  api.ProbeSuccess,
+		LatencyP95:       &meta.Duration{Duration: stats.LatencyP95},
+		RecentRequests:   stats.Requests,
+		RecentFailures:   stats.Failures,
+	}
+	if stats.LastProbeError != nil {
+		status.LastProbeResult = api.ProbeFailure
+		status.LastProbeMessage = stats.LastProbeError.Error()
+	}
+	iss.Status.CA = status
+}
+
+// result returns the result of a successful reconciliation, requeuing the
+// StepIssuer for the next probe.
+func (r *StepIssuerReconciler) result() ctrl.Result {
+	if r.ProbeInterval <= 0 {
+		return ctrl.Result{}
+	}
+	return ctrl.Result{RequeueAfter: r.ProbeInterval}
 }
 
 // SetupWithManager initializes the StepIssuer controller into the controller
-// runtime.
+// runtime. Updates that do not change the spec are ignored, so the updates of
+// the status do not trigger a new reconciliation. The secrets are watched too,
+// only their metadata is cached, so StepIssuers are reconciled when a password
+// or a client certificate changes.
 func (r *StepIssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&api.StepIssuer{}).
+		For(&api.StepIssuer{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &core.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.stepIssuersForSecret),
+			builder.OnlyMetadata).
 		Complete(r)
 }
 
 func validateStepIssuerSpec(s api.StepIssuerSpec) error {
+	profiles := make(map[string]bool, len(s.Profiles))
+	for i, p := range s.Profiles {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("spec.profiles[%d].name cannot be empty", i)
+		case profiles[p.Name]:
+			return fmt.Errorf("spec.profiles[%d].name %q is duplicated", i, p.Name)
+		case p.Provisioner.Name == "":
+			return fmt.Errorf("spec.profiles[%d].provisioner.name cannot be empty", i)
+		case p.Provisioner.KeyID == "":
+			return fmt.Errorf("spec.profiles[%d].provisioner.kid cannot be empty", i)
+		case p.Provisioner.PasswordRef.Name == "":
+			return fmt.Errorf("spec.profiles[%d].provisioner.passwordRef.name cannot be empty", i)
+		case p.Provisioner.PasswordRef.Key == "":
+			return fmt.Errorf("spec.profiles[%d].provisioner.passwordRef.key cannot be empty", i)
+		}
+		profiles[p.Name] = true
+	}
+
 	switch {
 	case s.URL == "":
 		return fmt.Errorf("spec.url cannot be empty")
@@ -118,6 +452,10 @@ func validateStepIssuerSpec(s api.StepIssuerSpec) error {
 		return fmt.Errorf("spec.provisioner.passwordRef.name cannot be empty")
 	case s.Provisioner.PasswordRef.Key == "":
 		return fmt.Errorf("spec.provisioner.passwordRef.key cannot be empty")
+	case s.ClientCertificateRef != nil && s.ClientCertificateRef.Name == "":
+		return fmt.Errorf("spec.clientCertificateRef.name cannot be empty")
+	case s.ClientCertificateRef != nil && len(s.CABundle) == 0:
+		return fmt.Errorf("spec.caBundle cannot be empty if spec.clientCertificateRef is set")
 	default:
 		return nil
 	}
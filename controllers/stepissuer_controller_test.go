@@ -0,0 +1,304 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/provisioners"
+	"go.step.sm/crypto/jose"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	testKeyID    = "test-kid"
+	testPassword = "password"
+)
+
+// newTestCA starts a fake CA that serves the encrypted key of a JWK
+// provisioner with testKeyID and testPassword. It returns the server and its
+// root certificate in PEM format.
+func newTestCA(t *testing.T) (*httptest.Server, []byte) {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", testKeyID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := jose.EncryptJWK(jwk, []byte(testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := jwe.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/provisioners/"+testKeyID+"/encrypted-key", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"key": encryptedKey})
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+}
+
+// newTestStepIssuerReconciler returns a reconciler and a StepIssuer with the
+// given name pointing to a fake CA. The provisioner password is only
+// available to the secret reader.
+func newTestStepIssuerReconciler(t *testing.T, name string) (*StepIssuerReconciler, *api.StepIssuer) {
+	t.Helper()
+	srv, root := newTestCA(t)
+	iss := &api.StepIssuer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "default",
+			Name:       name,
+			Generation: 1,
+		},
+		Spec: api.StepIssuerSpec{
+			URL:      srv.URL,
+			CABundle: root,
+			Provisioner: api.StepProvisioner{
+				Name:  "test",
+				KeyID: testKeyID,
+				PasswordRef: api.SecretKeySelector{
+					Name: "password",
+					Key:  "password",
+				},
+			},
+		},
+	}
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "password"},
+		Data:       map[string][]byte{"password": []byte(testPassword)},
+	}
+
+	s := newTestScheme(t)
+	if err := core.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		provisioners.Delete(client.ObjectKeyFromObject(iss))
+	})
+	return &StepIssuerReconciler{
+		Client:       fake.NewClientBuilder().WithScheme(s).WithObjects(iss).Build(),
+		SecretReader: fake.NewClientBuilder().WithScheme(s).WithObjects(secret).Build(),
+		Log:          logf.Log,
+		Clock:        clock.RealClock{},
+		Recorder:     record.NewFakeRecorder(100),
+	}, iss
+}
+
+// reconcileStepIssuer reconciles the given StepIssuer and returns its
+// updated version.
+func reconcileStepIssuer(t *testing.T, r *StepIssuerReconciler, iss *api.StepIssuer) (*api.StepIssuer, error) {
+	t.Helper()
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(iss)})
+	got := new(api.StepIssuer)
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(iss), got); err != nil {
+		t.Fatal(err)
+	}
+	return got, err
+}
+
+// updateStepIssuer applies fn to the stored StepIssuer, the fake client also
+// updates its status.
+func updateStepIssuer(t *testing.T, r *StepIssuerReconciler, iss *api.StepIssuer, fn func(*api.StepIssuer)) {
+	t.Helper()
+	got := new(api.StepIssuer)
+	if err := r.Client.Get(context.Background(), client.ObjectKeyFromObject(iss), got); err != nil {
+		t.Fatal(err)
+	}
+	fn(got)
+	if err := r.Client.Update(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isReady(iss *api.StepIssuer) bool {
+	return stepIssuerHasCondition(*iss, api.StepIssuerCondition{Type: api.ConditionReady, Status: api.ConditionTrue})
+}
+
+func TestStepIssuerReconcilerReuseSetsReady(t *testing.T) {
+	r, iss := newTestStepIssuerReconciler(t, "reuse")
+
+	got, err := reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Fatalf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+	p, ok := provisioners.Load(client.ObjectKeyFromObject(iss))
+	if !ok {
+		t.Fatal("provisioner not stored")
+	}
+
+	// The update of the Ready condition after storing the provisioner
+	// failed, the next reconciliation must set it.
+	updateStepIssuer(t, r, iss, func(iss *api.StepIssuer) {
+		iss.Status.Conditions[0].Status = api.ConditionFalse
+		iss.Status.Conditions[0].Reason = "Error"
+	})
+	got, err = reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Errorf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+	if reused, _ := provisioners.Load(client.ObjectKeyFromObject(iss)); reused != p {
+		t.Error("provisioner has been recreated")
+	}
+}
+
+func TestStepIssuerReconcilerRevert(t *testing.T) {
+	r, iss := newTestStepIssuerReconciler(t, "revert")
+
+	got, err := reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Fatalf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+
+	// A bad kid fails and removes the previous provisioner.
+	updateStepIssuer(t, r, iss, func(iss *api.StepIssuer) {
+		iss.Generation = 2
+		iss.Spec.Provisioner.KeyID = "bad-kid"
+	})
+	got, err = reconcileStepIssuer(t, r, iss)
+	if err == nil {
+		t.Fatal("Reconcile() error = nil, want error")
+	}
+	if isReady(got) {
+		t.Fatalf("StepIssuer is Ready: %v", got.Status.Conditions)
+	}
+	if _, ok := provisioners.Load(client.ObjectKeyFromObject(iss)); ok {
+		t.Fatal("provisioner of the previous spec is still stored")
+	}
+
+	// Reverting the spec makes the StepIssuer Ready again.
+	updateStepIssuer(t, r, iss, func(iss *api.StepIssuer) {
+		iss.Generation = 3
+		iss.Spec.Provisioner.KeyID = testKeyID
+	})
+	got, err = reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Errorf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+}
+
+func TestStepIssuerReconcilerPolicyChange(t *testing.T) {
+	r, iss := newTestStepIssuerReconciler(t, "policy")
+
+	got, err := reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Fatalf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+	p, ok := provisioners.Load(client.ObjectKeyFromObject(iss))
+	if !ok {
+		t.Fatal("provisioner not stored")
+	}
+
+	// A policy change while the StepIssuer is not Ready reuses the
+	// provisioner and makes it Ready again.
+	updateStepIssuer(t, r, iss, func(iss *api.StepIssuer) {
+		iss.Generation = 2
+		iss.Spec.Policy = &api.StepPolicy{AllowedSANTypes: []api.SANType{api.SANTypeDNS}}
+		iss.Status.Conditions[0].Status = api.ConditionFalse
+		iss.Status.Conditions[0].Reason = "Error"
+	})
+	got, err = reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Errorf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+	if reused, _ := provisioners.Load(client.ObjectKeyFromObject(iss)); reused != p {
+		t.Error("provisioner has been recreated")
+	}
+}
+
+// countingReader counts the reads of the underlying reader.
+type countingReader struct {
+	client.Reader
+	gets int
+}
+
+func (r *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	r.gets++
+	return r.Reader.Get(ctx, key, obj)
+}
+
+func TestStepIssuerReconcilerOnDemandKeys(t *testing.T) {
+	r, iss := newTestStepIssuerReconciler(t, "on-demand")
+	reader := &countingReader{Reader: r.SecretReader}
+	r.SecretReader = reader
+	r.OnDemandKeys = true
+
+	// The password is only read by the provisioner when it is created.
+	got, err := reconcileStepIssuer(t, r, iss)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !isReady(got) {
+		t.Fatalf("StepIssuer is not Ready: %v", got.Status.Conditions)
+	}
+	if reader.gets != 1 {
+		t.Errorf("secret reads = %d, want 1", reader.gets)
+	}
+
+	// A missing password secret is still reported as NotFound.
+	updateStepIssuer(t, r, iss, func(iss *api.StepIssuer) {
+		iss.Generation = 2
+		iss.Spec.Provisioner.PasswordRef.Name = "missing"
+	})
+	got, err = reconcileStepIssuer(t, r, iss)
+	if err == nil {
+		t.Fatal("Reconcile() error = nil, want error")
+	}
+	if !stepIssuerHasCondition(*got, api.StepIssuerCondition{Type: api.ConditionReady, Status: api.ConditionFalse}) {
+		t.Fatalf("StepIssuer is Ready: %v", got.Status.Conditions)
+	}
+	if reason := got.Status.Conditions[0].Reason; reason != "NotFound" {
+		t.Errorf("Ready reason = %q, want NotFound", reason)
+	}
+}
@@ -0,0 +1,74 @@
+#!/usr/bin/env bash
+
+# Runs the end-to-end tests in a kind cluster with cert-manager, step
+# certificates and step-issuer.
+#
+# To run the tests against an existing installation, for example as a
+# conformance check before an upgrade, set SKIP_SETUP=true and point NAMESPACE
+# and ISSUER_NAME to a ready StepIssuer in the current kubeconfig context.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+CLUSTER_NAME=${CLUSTER_NAME:-step-issuer-e2e}
+CERT_MANAGER_VERSION=${CERT_MANAGER_VERSION:-v1.3.1}
+IMG=${IMG:-smallstep/step-issuer:e2e}
+NAMESPACE=${NAMESPACE:-step-issuer-e2e}
+ISSUER_NAME=${ISSUER_NAME:-step-issuer}
+SKIP_SETUP=${SKIP_SETUP:-false}
+TIMEOUT=${TIMEOUT:-3m}
+
+setup() {
+	if ! kind get clusters | grep -qx "${CLUSTER_NAME}"; then
+		kind create cluster --name "${CLUSTER_NAME}"
+	fi
+	kubectl config use-context "kind-${CLUSTER_NAME}"
+
+	echo "Installing cert-manager ${CERT_MANAGER_VERSION}"
+	kubectl apply -f "https://github.com/jetstack/cert-manager/releases/download/${CERT_MANAGER_VERSION}/cert-manager.yaml"
+	kubectl -n cert-manager wait --for=condition=Available --timeout=5m deployment --all
+
+	echo "Installing step certificates"
+	helm repo add smallstep https://smallstep.github.io/helm-charts
+	helm repo update
+	helm upgrade --install --wait --create-namespace -n "${NAMESPACE}" step-certificates smallstep/step-certificates
+
+	echo "Installing step-issuer ${IMG}"
+	make docker IMG="${IMG}"
+	kind load docker-image --name "${CLUSTER_NAME}" "${IMG}"
+	make manifests
+	kubectl apply -f config/crd/bases
+	kustomize build config/default | sed -e "s|image: smallstep/step-issuer:.*|image: ${IMG}|" | kubectl apply -f -
+	kubectl -n step-issuer-system wait --for=condition=Available --timeout=5m deployment --all
+
+	echo "Creating StepIssuer ${NAMESPACE}/${ISSUER_NAME}"
+	local root kid
+	root=$(kubectl -n "${NAMESPACE}" get -o jsonpath="{.data['root_ca\.crt']}" configmaps/step-certificates-certs | base64 | tr -d '\n')
+	kid=$(kubectl -n "${NAMESPACE}" get -o jsonpath="{.data['ca\.json']}" configmaps/step-certificates-config | jq -r .authority.provisioners[0].key.kid)
+	cat <<-YAML | kubectl apply -f -
+	apiVersion: certmanager.step.sm/v1beta1
+	kind: StepIssuer
+	metadata:
+	  name: ${ISSUER_NAME}
+	  namespace: ${NAMESPACE}
+	spec:
+	  url: https://step-certificates.${NAMESPACE}.svc.cluster.local
+	  caBundle: ${root}
+	  provisioner:
+	    name: admin
+	    kid: ${kid}
+	    passwordRef:
+	      name: step-certificates-provisioner-password
+	      key: password
+	YAML
+}
+
+if [ "${SKIP_SETUP}" != "true" ]; then
+	setup
+fi
+
+go test -tags e2e -count=1 -timeout 30m -v ./test/e2e/... -args \
+	-e2e.namespace="${NAMESPACE}" \
+	-e2e.issuer-name="${ISSUER_NAME}" \
+	-e2e.timeout="${TIMEOUT}"
@@ -18,11 +18,14 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	stepv1beta1 "github.com/smallstep/step-issuer/api/v1beta1"
 	"github.com/smallstep/step-issuer/controllers"
+	"github.com/smallstep/step-issuer/provisioners"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/utils/clock"
@@ -48,6 +51,12 @@ func main() {
 	var enableLeaderElection bool
 	var leaderElectionID string
 	var disableApprovedCheck bool
+	var clockSkew time.Duration
+	var caProbeInterval time.Duration
+	var onDemandKeys bool
+	var statusUpdateMinInterval time.Duration
+	var fips bool
+	var expiryDangerWindow time.Duration
 
 	// Options for configuring logging
 	opts := zap.Options{}
@@ -60,6 +69,18 @@ func main() {
 		"The name of the resource that leader election will use for holding the leader lock.")
 	flag.BoolVar(&disableApprovedCheck, "disable-approval-check", false,
 		"Disables waiting for CertificateRequests to have an approved condition before signing.")
+	flag.DurationVar(&clockSkew, "clock-skew", 0,
+		"The offset added to the local clock to match the clock of the CA.")
+	flag.DurationVar(&caProbeInterval, "ca-probe-interval", time.Minute,
+		"The interval at which the CA of ready StepIssuers is probed. Set to 0 to disable it.")
+	flag.BoolVar(&onDemandKeys, "on-demand-provisioner-keys", false,
+		"Reads the provisioner passwords and decrypts the keys every time a certificate is signed instead of keeping them in memory.")
+	flag.DurationVar(&statusUpdateMinInterval, "status-update-min-interval", 0,
+		"The minimum interval between the status updates of a pending CertificateRequest that do not change its condition. Set to 0 to disable it.")
+	flag.DurationVar(&expiryDangerWindow, "expiry-danger-window", 0,
+		"The time before the expiration of a certificate in which the signing failures of its renewals are escalated. Set to 0 to disable it.")
+	flag.BoolVar(&fips, "fips", false,
+		"Restricts the certificate requests, keys and TLS settings to FIPS approved algorithms. Requires a binary built with BoringCrypto.")
 	flag.Parse()
 
 	if enableLeaderElection && leaderElectionID == "" {
@@ -67,7 +88,13 @@ func main() {
 	}
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	if fips && !provisioners.FIPSCapable() {
+		setupLog.Info("flag -fips requires a binary built with a FIPS capable crypto backend")
+		os.Exit(1)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		LeaderElection:     enableLeaderElection,
@@ -78,22 +105,47 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The skew correction only applies to the requests to the CA, the
+	// timestamps of the Kubernetes resources use the local clock.
+	clk := provisioners.NewSkewedClock(clock.RealClock{}, clockSkew)
+
 	if err = (&controllers.StepIssuerReconciler{
-		Client:   mgr.GetClient(),
-		Log:      ctrl.Log.WithName("controllers").WithName("StepIssuer"),
-		Clock:    clock.RealClock{},
-		Recorder: mgr.GetEventRecorderFor("stepissuer-controller"),
+		Client:           mgr.GetClient(),
+		Log:              ctrl.Log.WithName("controllers").WithName("StepIssuer"),
+		Clock:            clock.RealClock{},
+		ProvisionerClock: clk,
+		Recorder:         mgr.GetEventRecorderFor("stepissuer-controller"),
+		ProbeInterval:    caProbeInterval,
+		SecretReader:     mgr.GetAPIReader(),
+		OnDemandKeys:     onDemandKeys,
+		FIPS:             fips,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "StepIssuer")
 		os.Exit(1)
 	}
 
-	if err = (&controllers.CertificateRequestReconciler{
-		Client:                 mgr.GetClient(),
-		Log:                    ctrl.Log.WithName("controllers").WithName("CertificateRequest"),
-		Recorder:               mgr.GetEventRecorderFor("certificaterequests-controller"),
-		Clock:                  clock.RealClock{},
-		CheckApprovedCondition: !disableApprovedCheck,
+	// The CertificateRequest controller is added once the cert-manager CRDs
+	// are available, so step-issuer can be installed before cert-manager.
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+	if err = (&controllers.CertManagerWaiter{
+		Discovery: discoveryClient,
+		Log:       ctrl.Log.WithName("setup").WithName("cert-manager"),
+		Setup: func() error {
+			return (&controllers.CertificateRequestReconciler{
+				Client:                 mgr.GetClient(),
+				Log:                    ctrl.Log.WithName("controllers").WithName("CertificateRequest"),
+				Recorder:               mgr.GetEventRecorderFor("certificaterequests-controller"),
+				Clock:                  clock.RealClock{},
+				CheckApprovedCondition: !disableApprovedCheck,
+
+				StatusUpdateMinInterval: statusUpdateMinInterval,
+				ExpiryDangerWindow:      expiryDangerWindow,
+			}).SetupWithManager(mgr)
+		},
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CertificateRequest")
 		os.Exit(1)
@@ -0,0 +1,34 @@
+package provisioners
+
+import (
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// skewedClock is a clock.Clock that adds a fixed offset to the time reported
+// by another clock.
+type skewedClock struct {
+	clock.Clock
+	skew time.Duration
+}
+
+// NewSkewedClock returns a clock that reports the time of the given clock plus
+// the given skew. It can be used to correct a known difference between the
+// local clock and the clock of the CA.
+func NewSkewedClock(c clock.Clock, skew time.Duration) clock.Clock {
+	if skew == 0 {
+		return c
+	}
+	return skewedClock{Clock: c, skew: skew}
+}
+
+// Now returns the current time with the skew applied.
+func (c skewedClock) Now() time.Time {
+	return c.Clock.Now().Add(c.skew)
+}
+
+// Since returns the time elapsed since t using the skewed time.
+func (c skewedClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
@@ -0,0 +1,117 @@
+package provisioners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+
+	capi "github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+)
+
+// fipsMinRSABits is the minimum size of the RSA keys accepted in FIPS mode.
+const fipsMinRSABits = 2048
+
+// fipsCipherSuites are the FIPS approved TLS 1.2 cipher suites.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsSignatureAlgorithms are the FIPS approved CSR signature algorithms.
+var fipsSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:    true,
+	x509.SHA384WithRSA:    true,
+	x509.SHA512WithRSA:    true,
+	x509.SHA256WithRSAPSS: true,
+	x509.SHA384WithRSAPSS: true,
+	x509.SHA512WithRSAPSS: true,
+	x509.ECDSAWithSHA256:  true,
+	x509.ECDSAWithSHA384:  true,
+	x509.ECDSAWithSHA512:  true,
+}
+
+// FIPSCapable returns true if the binary is built with a FIPS 140-2 validated
+// crypto backend, Go with BoringCrypto and the boringcrypto build tag.
+func FIPSCapable() bool {
+	return fipsCapable()
+}
+
+// ConfigureFIPSTLS restricts the given TLS configuration to TLS 1.2 with FIPS
+// approved cipher suites and curves.
+func ConfigureFIPSTLS(c *tls.Config) {
+	c.MinVersion = tls.VersionTLS12
+	c.MaxVersion = tls.VersionTLS12
+	c.CipherSuites = fipsCipherSuites
+	c.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
+
+// FIPSError is the error returned by Sign in FIPS mode when the certificate
+// request uses an algorithm that is not FIPS approved.
+type FIPSError struct {
+	msg string
+}
+
+func (e *FIPSError) Error() string {
+	return e.msg
+}
+
+// checkFIPS verifies that the key and the signature of the given certificate
+// request use FIPS approved algorithms: RSA keys of at least 2048 bits or
+// ECDSA keys with a NIST curve, signed using SHA-2.
+func checkFIPS(csr *x509.CertificateRequest) error {
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < fipsMinRSABits {
+			return &FIPSError{msg: fmt.Sprintf("RSA key of %d bits is not allowed in FIPS mode, the minimum is %d", key.N.BitLen(), fipsMinRSABits)}
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return &FIPSError{msg: fmt.Sprintf("ECDSA curve %s is not allowed in FIPS mode", key.Curve.Params().Name)}
+		}
+	default:
+		return &FIPSError{msg: fmt.Sprintf("%s keys are not allowed in FIPS mode", csr.PublicKeyAlgorithm)}
+	}
+	if !fipsSignatureAlgorithms[csr.SignatureAlgorithm] {
+		return &FIPSError{msg: fmt.Sprintf("signature algorithm %s is not allowed in FIPS mode", csr.SignatureAlgorithm)}
+	}
+	return nil
+}
+
+// fipsTLSOption is the option used to restrict the TLS configuration of the
+// transports created by the step certificates client.
+func fipsTLSOption(ctx *ca.TLSOptionCtx) error {
+	ConfigureFIPSTLS(ctx.Config)
+	return nil
+}
+
+// createFIPSCertificateRequest returns a certificate request for the given
+// common name with a new ECDSA P-256 key, signed using SHA-256.
+func createFIPSCertificateRequest(commonName string) (*capi.CertificateRequest, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:            pkix.Name{CommonName: commonName},
+		DNSNames:           []string{commonName},
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &capi.CertificateRequest{CertificateRequest: csr}, key, nil
+}
@@ -0,0 +1,10 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package provisioners
+
+import "crypto/boring"
+
+func fipsCapable() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,8 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package provisioners
+
+func fipsCapable() bool {
+	return false
+}
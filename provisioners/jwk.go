@@ -0,0 +1,160 @@
+package provisioners
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/smallstep/certificates/ca"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/randutil"
+	"k8s.io/utils/clock"
+)
+
+// PasswordFunc returns the password used to decrypt the key of a JWK
+// provisioner. The returned slice is zeroed after use, so it must not be
+// shared with the caller.
+type PasswordFunc func() ([]byte, error)
+
+// tokenLifetime is the validity of the one-time tokens.
+const tokenLifetime = 5 * time.Minute
+
+// tokenClaims are the claims of the one-time tokens of a JWK provisioner, the
+// sha claim is the fingerprint of the root of the CA.
+type tokenClaims struct {
+	jose.Claims
+	SHA  string   `json:"sha"`
+	SANs []string `json:"sans"`
+}
+
+// jwk creates the one-time tokens used to sign certificates with a JWK
+// provisioner. The decrypted key is either kept in memory, or decrypted on
+// demand for every token and released right after it is used. The tokens are
+// created using the clock of the provisioner, so their validity matches the
+// clock of the CA.
+type jwk struct {
+	name         string
+	kid          string
+	audience     string
+	fingerprint  string
+	encryptedKey string
+	clock        clock.Clock
+	key          *jose.JSONWebKey
+	password     PasswordFunc
+}
+
+// newJWK fetches the encrypted key of the given provisioner from the CA and
+// decrypts it to check the password. If onDemand is true the decrypted key is
+// discarded and it will be decrypted again using the password function every
+// time a token is created.
+func newJWK(prov api.StepProvisioner, caURL string, client *ca.Client, password PasswordFunc, onDemand bool, clk clock.Clock) (*jwk, error) {
+	u, err := url.Parse(caURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.ProvisionerKey(prov.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := client.RootFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	k := &jwk{
+		name:         prov.Name,
+		kid:          prov.KeyID,
+		audience:     u.ResolveReference(&url.URL{Path: "/1.0/sign"}).String(),
+		fingerprint:  fingerprint,
+		encryptedKey: resp.Key,
+		clock:        clk,
+	}
+	key, err := k.decrypt(password)
+	if err != nil {
+		return nil, err
+	}
+	if onDemand {
+		k.password = password
+	} else {
+		k.key = key
+	}
+	return k, nil
+}
+
+// Token returns a one-time token for the given subject and SANs.
+func (k *jwk) Token(subject string, sans ...string) (string, error) {
+	key := k.key
+	if key == nil {
+		var err error
+		if key, err = k.decrypt(k.password); err != nil {
+			return "", err
+		}
+	}
+	jwtID, err := randutil.Hex(64)
+	if err != nil {
+		return "", err
+	}
+	if len(sans) == 0 {
+		sans = []string{subject}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(key.Algorithm),
+		Key:       key.Key,
+	}, new(jose.SignerOptions).WithType("JWT").WithHeader("kid", k.kid))
+	if err != nil {
+		return "", err
+	}
+	now := k.clock.Now()
+	return jose.Signed(signer).Claims(tokenClaims{
+		Claims: jose.Claims{
+			ID:        jwtID,
+			Issuer:    k.name,
+			Subject:   subject,
+			Audience:  jose.Audience{k.audience},
+			IssuedAt:  jose.NewNumericDate(now),
+			NotBefore: jose.NewNumericDate(now),
+			Expiry:    jose.NewNumericDate(now.Add(tokenLifetime)),
+		},
+		SHA:  k.fingerprint,
+		SANs: sans,
+	}).CompactSerialize()
+}
+
+func (k *jwk) decrypt(password PasswordFunc) (*jose.JSONWebKey, error) {
+	b, err := password()
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(b)
+	enc, err := jose.ParseEncrypted(k.encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing provisioner key: %w", err)
+	}
+	data, err := enc.Decrypt(b)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting provisioner key: %w", err)
+	}
+	defer Zero(data)
+	key := new(jose.JSONWebKey)
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("error parsing provisioner key: %w", err)
+	}
+	return key, nil
+}
+
+// StaticPassword returns a PasswordFunc that always returns a copy of the
+// given password.
+func StaticPassword(password []byte) PasswordFunc {
+	return func() ([]byte, error) {
+		return append([]byte(nil), password...), nil
+	}
+}
+
+// Zero overwrites the given slice with zeros, it is used to remove passwords
+// and keys from memory once they are no longer needed.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,82 @@
+package provisioners
+
+import (
+	"testing"
+	"time"
+
+	"go.step.sm/crypto/jose"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// newTestJWK returns a jwk with a new key and the given clock, and the key
+// encrypted with the given password.
+func newTestJWK(t *testing.T, clk *clocktesting.FakeClock, password string) *jwk {
+	t.Helper()
+	key, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "test-kid", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwe, err := jose.EncryptJWK(key, []byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, err := jwe.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwk{
+		name:         "test",
+		kid:          "test-kid",
+		audience:     "https://ca.example.com/1.0/sign",
+		fingerprint:  "fingerprint",
+		encryptedKey: encryptedKey,
+		clock:        clk,
+	}
+}
+
+func TestJWKToken(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := clocktesting.NewFakeClock(now)
+	k := newTestJWK(t, clk, "password")
+	k.password = StaticPassword([]byte("password"))
+
+	tok, err := k.Token("example.com", "example.com", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	jwt, err := jose.ParseSigned(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims jose.Claims
+	if err := jwt.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if got := claims.IssuedAt.Time(); !got.Equal(now) {
+		t.Errorf("iat = %v, want %v", got, now)
+	}
+	if got := claims.NotBefore.Time(); !got.Equal(now) {
+		t.Errorf("nbf = %v, want %v", got, now)
+	}
+	if got, want := claims.Expiry.Time(), now.Add(tokenLifetime); !got.Equal(want) {
+		t.Errorf("exp = %v, want %v", got, want)
+	}
+	if claims.Subject != "example.com" || claims.Issuer != "test" {
+		t.Errorf("sub = %s, iss = %s, want example.com and test", claims.Subject, claims.Issuer)
+	}
+}
+
+func TestJWKTokenOnDemand(t *testing.T) {
+	clk := clocktesting.NewFakeClock(time.Now())
+	k := newTestJWK(t, clk, "password")
+
+	k.password = StaticPassword([]byte("password"))
+	if _, err := k.Token("example.com"); err != nil {
+		t.Errorf("Token() error = %v", err)
+	}
+
+	k.password = StaticPassword([]byte("wrong"))
+	if _, err := k.Token("example.com"); err == nil {
+		t.Error("Token() error = nil, want error with the wrong password")
+	}
+}
@@ -0,0 +1,114 @@
+package provisioners
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/smallstep/certificates/ca"
+	"k8s.io/utils/clock"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Option configures a Step provisioner created with NewWithOptions.
+type Option func(*options)
+
+type options struct {
+	identity   *tls.Certificate
+	clock      clock.Clock
+	onDemand   bool
+	fips       bool
+	httpClient *http.Client
+	caOptions  []ca.ClientOption
+	log        logr.Logger
+	secrets    map[string]string
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		clock: clock.RealClock{},
+		log:   logf.Log.WithName("provisioners"),
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+	return o
+}
+
+// WithIdentity sets the client certificate used in all the connections to the
+// CA. The roots in the CABundle of the StepIssuer are used instead of the ones
+// returned by the CA.
+func WithIdentity(identity *tls.Certificate) Option {
+	return func(o *options) {
+		o.identity = identity
+	}
+}
+
+// WithClock sets the clock used to create the one-time tokens and to backdate
+// certificates. A nil clock uses the system clock.
+func WithClock(clk clock.Clock) Option {
+	return func(o *options) {
+		if clk != nil {
+			o.clock = clk
+		}
+	}
+}
+
+// WithOnDemandKeys disables keeping the decrypted provisioner keys in memory,
+// the password function is used to decrypt the key every time a certificate is
+// signed.
+//
+// The password and the decrypted JSON are zeroed after every use, but the
+// parsed jose.JSONWebKey is not. It is only released to the garbage collector
+// after the token is created, so it may remain in memory until it is reclaimed
+// and overwritten.
+func WithOnDemandKeys() Option {
+	return func(o *options) {
+		o.onDemand = true
+	}
+}
+
+// WithFIPS enables the FIPS mode: the connections to the CA use FIPS approved
+// TLS settings, the identity keys are ECDSA P-256 keys, and Sign rejects with a
+// FIPSError the certificate requests using algorithms that are not approved.
+// Creating the provisioner fails if the binary is not FIPSCapable.
+func WithFIPS() Option {
+	return func(o *options) {
+		o.fips = true
+	}
+}
+
+// WithHTTPClient sets the HTTP client whose transport is used for all the
+// connections to the CA. The transport must trust the CA, the CABundle of the
+// StepIssuer is not added to it. It cannot be combined with WithIdentity or
+// WithFIPS.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithCAOptions adds options to the step certificates clients used to connect
+// to the CA and to create the provisioner tokens.
+func WithCAOptions(opts ...ca.ClientOption) Option {
+	return func(o *options) {
+		o.caOptions = append(o.caOptions, opts...)
+	}
+}
+
+// WithSecretVersions sets the resource versions of the secrets used to create
+// the provisioner, indexed by secret name. They are compared by Matches, so a
+// provisioner is not reused after one of its secrets changes.
+func WithSecretVersions(versions map[string]string) Option {
+	return func(o *options) {
+		o.secrets = versions
+	}
+}
+
+// WithLogger sets the logger of the provisioner, by default the
+// controller-runtime logger is used.
+func WithLogger(log logr.Logger) Option {
+	return func(o *options) {
+		o.log = log
+	}
+}
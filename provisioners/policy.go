@@ -0,0 +1,234 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+)
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// keyUsages contains the cert-manager names of the key usages, in the order
+// of the bits in the key usage extension.
+var keyUsages = []certmanager.KeyUsage{
+	certmanager.UsageDigitalSignature,
+	certmanager.UsageContentCommitment,
+	certmanager.UsageKeyEncipherment,
+	certmanager.UsageDataEncipherment,
+	certmanager.UsageKeyAgreement,
+	certmanager.UsageCertSign,
+	certmanager.UsageCRLSign,
+	certmanager.UsageEncipherOnly,
+	certmanager.UsageDecipherOnly,
+}
+
+// extKeyUsages maps the OIDs of the extended key usages to the cert-manager
+// names.
+var extKeyUsages = []struct {
+	oid  asn1.ObjectIdentifier
+	name certmanager.KeyUsage
+}{
+	{asn1.ObjectIdentifier{2, 5, 29, 37, 0}, certmanager.UsageAny},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}, certmanager.UsageServerAuth},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}, certmanager.UsageClientAuth},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}, certmanager.UsageCodeSigning},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}, certmanager.UsageEmailProtection},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 5}, certmanager.UsageIPsecEndSystem},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 6}, certmanager.UsageIPsecTunnel},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 7}, certmanager.UsageIPsecUser},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}, certmanager.UsageTimestamping},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}, certmanager.UsageOCSPSigning},
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 10, 3, 3}, certmanager.UsageMicrosoftSGC},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 4, 1}, certmanager.UsageNetscapeSGC},
+}
+
+// CheckPolicy verifies that the given CertificateRequest is allowed by the
+// policy of a StepIssuer. A nil policy allows all requests.
+func CheckPolicy(policy *api.StepPolicy, cr *certmanager.CertificateRequest) error {
+	if policy == nil {
+		return nil
+	}
+
+	csr, err := decodeCSR(cr.Spec.Request)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSANTypes(policy.AllowedSANTypes, csr); err != nil {
+		return err
+	}
+	return checkUsages(policy.AllowedUsages, cr, csr)
+}
+
+// checkSANTypes returns an error listing all the SANs in the certificate
+// request with a type not present in the allowed list. An empty list allows
+// all types.
+func checkSANTypes(allowed []api.SANType, csr *x509.CertificateRequest) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	isAllowed := make(map[api.SANType]bool, len(allowed))
+	for _, t := range allowed {
+		isAllowed[t] = true
+	}
+
+	var rejected []string
+	for _, san := range requestedSANs(csr) {
+		if !isAllowed[san.typ] {
+			rejected = append(rejected, fmt.Sprintf("%s %s", san.typ, san.value))
+		}
+	}
+
+	if len(rejected) > 0 {
+		types := make([]string, len(allowed))
+		for i, t := range allowed {
+			types[i] = string(t)
+		}
+		return fmt.Errorf("SANs %s are not allowed, allowed SAN types are %s",
+			strings.Join(rejected, ", "), strings.Join(types, ", "))
+	}
+	return nil
+}
+
+// typedSAN is a subject alternative name with its type.
+type typedSAN struct {
+	typ   api.SANType
+	value string
+}
+
+// requestedSANs returns the SANs that the certificate signed for the given
+// request will have. If the request has no SANs the token only contains the
+// subject, and the CA adds it as a SAN of the type it looks like.
+func requestedSANs(csr *x509.CertificateRequest) []typedSAN {
+	var sans []typedSAN
+	for _, s := range csr.DNSNames {
+		sans = append(sans, typedSAN{api.SANTypeDNS, s})
+	}
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, typedSAN{api.SANTypeIP, ip.String()})
+	}
+	for _, u := range csr.URIs {
+		sans = append(sans, typedSAN{api.SANTypeURI, u.String()})
+	}
+	for _, s := range csr.EmailAddresses {
+		sans = append(sans, typedSAN{api.SANTypeEmail, s})
+	}
+
+	if len(sans) == 0 {
+		subject := csr.Subject.CommonName
+		if subject == "" {
+			subject = generateSubject(nil)
+		}
+		sans = append(sans, typedSAN{sanType(subject), subject})
+	}
+	return sans
+}
+
+// sanType returns the type of SAN the CA uses for a SAN in a token.
+func sanType(s string) api.SANType {
+	if net.ParseIP(s) != nil {
+		return api.SANTypeIP
+	}
+	if strings.Contains(s, "@") {
+		return api.SANTypeEmail
+	}
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return api.SANTypeURI
+	}
+	return api.SANTypeDNS
+}
+
+// checkUsages returns an error listing all the usages requested in the
+// CertificateRequest or in the extensions of the CSR that are not present in
+// the allowed list. An empty list allows all usages.
+func checkUsages(allowed []certmanager.KeyUsage, cr *certmanager.CertificateRequest, csr *x509.CertificateRequest) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	requested, err := csrUsages(csr)
+	if err != nil {
+		return err
+	}
+	requested = append(requested, cr.Spec.Usages...)
+	if cr.Spec.IsCA {
+		requested = append(requested, certmanager.UsageCertSign)
+	}
+
+	isAllowed := make(map[certmanager.KeyUsage]bool, len(allowed))
+	for _, u := range allowed {
+		isAllowed[u] = true
+	}
+	// "signing" is the cert-manager alias of "digital signature"
+	if isAllowed[certmanager.UsageDigitalSignature] || isAllowed[certmanager.UsageSigning] {
+		isAllowed[certmanager.UsageDigitalSignature] = true
+		isAllowed[certmanager.UsageSigning] = true
+	}
+
+	var rejected []string
+	seen := make(map[certmanager.KeyUsage]bool)
+	for _, u := range requested {
+		if !isAllowed[u] && !seen[u] {
+			rejected = append(rejected, string(u))
+		}
+		seen[u] = true
+	}
+
+	if len(rejected) > 0 {
+		usages := make([]string, len(allowed))
+		for i, u := range allowed {
+			usages[i] = string(u)
+		}
+		return fmt.Errorf("usages %s are not allowed, allowed usages are %s",
+			strings.Join(rejected, ", "), strings.Join(usages, ", "))
+	}
+	return nil
+}
+
+// csrUsages returns the key usages and extended key usages in the extensions
+// of the CSR. Unknown extended key usages are returned using their OID.
+func csrUsages(csr *x509.CertificateRequest) ([]certmanager.KeyUsage, error) {
+	var usages []certmanager.KeyUsage
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionKeyUsage):
+			var bits asn1.BitString
+			if _, err := asn1.Unmarshal(ext.Value, &bits); err != nil {
+				return nil, fmt.Errorf("error parsing key usage extension: %v", err)
+			}
+			for i, name := range keyUsages {
+				if bits.At(i) != 0 {
+					usages = append(usages, name)
+				}
+			}
+		case ext.Id.Equal(oidExtensionExtendedKeyUsage):
+			var oids []asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(ext.Value, &oids); err != nil {
+				return nil, fmt.Errorf("error parsing extended key usage extension: %v", err)
+			}
+			for _, oid := range oids {
+				usages = append(usages, extKeyUsageName(oid))
+			}
+		}
+	}
+	return usages, nil
+}
+
+func extKeyUsageName(oid asn1.ObjectIdentifier) certmanager.KeyUsage {
+	for _, eku := range extKeyUsages {
+		if oid.Equal(eku.oid) {
+			return eku.name
+		}
+	}
+	return certmanager.KeyUsage(oid.String())
+}
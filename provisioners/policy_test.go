@@ -0,0 +1,141 @@
+package provisioners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"testing"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+)
+
+// newTestCSR returns the given certificate request template signed with a new
+// key, in PEM format.
+func newTestCSR(t *testing.T, tmpl *x509.CertificateRequest) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func newTestCertificateRequest(t *testing.T, tmpl *x509.CertificateRequest) *certmanager.CertificateRequest {
+	return &certmanager.CertificateRequest{
+		Spec: certmanager.CertificateRequestSpec{
+			Request: newTestCSR(t, tmpl),
+		},
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCheckPolicySANTypes(t *testing.T) {
+	dnsOnly := &api.StepPolicy{AllowedSANTypes: []api.SANType{api.SANTypeDNS}}
+	u, _ := url.Parse("spiffe://example.com/workload")
+
+	tests := []struct {
+		name    string
+		policy  *api.StepPolicy
+		tmpl    *x509.CertificateRequest
+		wantErr bool
+	}{
+		{"nil policy", nil, &x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+		{"empty policy", &api.StepPolicy{}, &x509.CertificateRequest{URIs: []*url.URL{u}}, false},
+		{"allowed DNS", dnsOnly, &x509.CertificateRequest{DNSNames: []string{"example.com"}}, false},
+		{"rejected IP", dnsOnly, &x509.CertificateRequest{DNSNames: []string{"example.com"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, true},
+		{"rejected URI", dnsOnly, &x509.CertificateRequest{URIs: []*url.URL{u}}, true},
+		{"rejected email", dnsOnly, &x509.CertificateRequest{EmailAddresses: []string{"jane@example.com"}}, true},
+		{"allowed DNS subject", dnsOnly, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "example.com"}}, false},
+		{"rejected IP subject", dnsOnly, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}}, true},
+		{"rejected IPv6 subject", dnsOnly, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "2001:db8::1"}}, true},
+		{"rejected email subject", dnsOnly, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "jane@example.com"}}, true},
+		{"ignored subject with SANs", dnsOnly, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}, DNSNames: []string{"example.com"}}, false},
+		{"default subject", dnsOnly, &x509.CertificateRequest{}, false},
+		{"IP only", &api.StepPolicy{AllowedSANTypes: []api.SANType{api.SANTypeIP}}, &x509.CertificateRequest{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPolicy(tt.policy, newTestCertificateRequest(t, tt.tmpl))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyUsages(t *testing.T) {
+	serverOnly := &api.StepPolicy{AllowedUsages: []certmanager.KeyUsage{
+		certmanager.UsageDigitalSignature, certmanager.UsageKeyEncipherment, certmanager.UsageServerAuth,
+	}}
+	keyUsage := func(bits byte, length int) []byte {
+		return mustMarshal(t, asn1.BitString{Bytes: []byte{bits}, BitLength: length})
+	}
+	extKeyUsage := func(oids ...asn1.ObjectIdentifier) []byte {
+		return mustMarshal(t, oids)
+	}
+	serverAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	codeSigning := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+	unknown := asn1.ObjectIdentifier{1, 2, 3, 4}
+
+	tests := []struct {
+		name       string
+		policy     *api.StepPolicy
+		usages     []certmanager.KeyUsage
+		isCA       bool
+		extensions []pkix.Extension
+		wantErr    bool
+	}{
+		{"nil policy", nil, []certmanager.KeyUsage{certmanager.UsageCodeSigning}, false, nil, false},
+		{"no usages", serverOnly, nil, false, nil, false},
+		{"allowed usages", serverOnly, []certmanager.KeyUsage{certmanager.UsageDigitalSignature, certmanager.UsageServerAuth}, false, nil, false},
+		{"signing alias", serverOnly, []certmanager.KeyUsage{certmanager.UsageSigning}, false, nil, false},
+		{"rejected usage", serverOnly, []certmanager.KeyUsage{certmanager.UsageCodeSigning}, false, nil, true},
+		{"rejected CA", serverOnly, nil, true, nil, true},
+		{"allowed CSR extensions", serverOnly, nil, false, []pkix.Extension{
+			{Id: oidExtensionKeyUsage, Value: keyUsage(0xa0, 3)},
+			{Id: oidExtensionExtendedKeyUsage, Value: extKeyUsage(serverAuth)},
+		}, false},
+		{"rejected CSR key usage", serverOnly, nil, false, []pkix.Extension{
+			{Id: oidExtensionKeyUsage, Value: keyUsage(0x04, 6)},
+		}, true},
+		{"rejected CSR extended key usage", serverOnly, nil, false, []pkix.Extension{
+			{Id: oidExtensionExtendedKeyUsage, Value: extKeyUsage(serverAuth, codeSigning)},
+		}, true},
+		{"rejected unknown extended key usage", serverOnly, nil, false, []pkix.Extension{
+			{Id: oidExtensionExtendedKeyUsage, Value: extKeyUsage(unknown)},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := newTestCertificateRequest(t, &x509.CertificateRequest{
+				DNSNames:        []string{"example.com"},
+				ExtraExtensions: tt.extensions,
+			})
+			cr.Spec.Usages = tt.usages
+			cr.Spec.IsCA = tt.isCA
+			err := CheckPolicy(tt.policy, cr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// csrSANs returns the SANs in the certificate request as they are sent in the
+// token. Duplicated SANs are only sent once, IP addresses are sent in the form
+// returned by net.IP.String, so IPv4-mapped IPv6 addresses are sent as IPv4.
+//
+// DNS names that net.ParseIP parses as IP addresses are rejected, the CA
+// classifies the token SANs the same way, so it would expect them as IP SANs in
+// the certificate request and reject it with a SAN mismatch.
+func csrSANs(csr *x509.CertificateRequest) ([]string, error) {
+	var sans []string
+	seen := make(map[string]bool)
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			sans = append(sans, s)
+		}
+	}
+
+	for _, name := range csr.DNSNames {
+		if net.ParseIP(name) != nil {
+			return nil, fmt.Errorf("DNS SAN %s is an IP address, it must be requested as an IP SAN", name)
+		}
+		add(name)
+	}
+	for _, email := range csr.EmailAddresses {
+		add(email)
+	}
+	for _, ip := range csr.IPAddresses {
+		add(ip.String())
+	}
+	for _, u := range csr.URIs {
+		add(u.String())
+	}
+	return sans, nil
+}
+
+// isLoopback returns true if the SAN is localhost or a loopback address.
+func isLoopback(san string) bool {
+	if san == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(san)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,85 @@
+package provisioners
+
+import (
+	"crypto/x509"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCSRSANs(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.com/workload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		csr     *x509.CertificateRequest
+		want    []string
+		wantErr bool
+	}{
+		{"empty", &x509.CertificateRequest{}, nil, false},
+		{"all types", &x509.CertificateRequest{
+			DNSNames:       []string{"example.com"},
+			EmailAddresses: []string{"admin@example.com"},
+			IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+			URIs:           []*url.URL{uri},
+		}, []string{"example.com", "admin@example.com", "10.0.0.1", "spiffe://example.com/workload"}, false},
+		{"duplicated DNS names", &x509.CertificateRequest{
+			DNSNames: []string{"example.com", "www.example.com", "example.com"},
+		}, []string{"example.com", "www.example.com"}, false},
+		{"duplicated IPs", &x509.CertificateRequest{
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::ffff:10.0.0.1").To16(), net.IPv4(10, 0, 0, 1).To4()},
+		}, []string{"10.0.0.1"}, false},
+		{"IPv6", &x509.CertificateRequest{
+			IPAddresses: []net.IP{net.ParseIP("2001:db8:0:0:0:0:0:1"), net.ParseIP("2001:db8::1")},
+		}, []string{"2001:db8::1"}, false},
+		{"IPv4 DNS name", &x509.CertificateRequest{
+			DNSNames: []string{"10.0.0.1"},
+		}, nil, true},
+		{"IPv6 DNS name", &x509.CertificateRequest{
+			DNSNames: []string{"2001:db8::1"},
+		}, nil, true},
+		{"bracketed IPv6 DNS name", &x509.CertificateRequest{
+			DNSNames: []string{"[2001:db8::1]"},
+		}, []string{"[2001:db8::1]"}, false},
+		{"IPv6 DNS name with zone", &x509.CertificateRequest{
+			DNSNames: []string{"fe80::1%eth0"},
+		}, []string{"fe80::1%eth0"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := csrSANs(tt.csr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("csrSANs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("csrSANs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		sans []string
+		want string
+	}{
+		{"no SANs", nil, "step-issuer-certificate"},
+		{"first SAN", []string{"example.com", "www.example.com"}, "example.com"},
+		{"skip localhost", []string{"localhost", "example.com"}, "example.com"},
+		{"skip IPv4 loopback", []string{"127.0.0.1", "10.0.0.1"}, "10.0.0.1"},
+		{"skip IPv6 loopback", []string{"::1", "example.com"}, "example.com"},
+		{"only loopbacks", []string{"localhost", "127.0.0.1"}, "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := generateSubject(tt.sans); got != tt.want {
+				t.Errorf("generateSubject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package provisioners
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsWindowSize is the number of recent requests to the CA used to compute
+// the statistics of a provisioner.
+const statsWindowSize = 20
+
+// Stats contains the latency and outcome of the recent requests made by a
+// provisioner to the CA.
+type Stats struct {
+	// LastProbeTime is the time of the last health check, zero if the CA has
+	// not been probed yet.
+	LastProbeTime time.Time
+
+	// LastProbeLatency is the latency of the last health check.
+	LastProbeLatency time.Duration
+
+	// LastProbeError is the error of the last health check, nil if it
+	// succeeded.
+	LastProbeError error
+
+	// LatencyP95 is the 95th percentile of the latency of the recent requests.
+	LatencyP95 time.Duration
+
+	// Requests is the number of recent requests.
+	Requests int
+
+	// Failures is the number of recent requests that failed.
+	Failures int
+}
+
+type request struct {
+	latency time.Duration
+	failed  bool
+}
+
+// requestStats keeps a rolling window with the latest requests to the CA.
+type requestStats struct {
+	mu        sync.Mutex
+	requests  []request
+	next      int
+	lastProbe struct {
+		time    time.Time
+		latency time.Duration
+		err     error
+	}
+}
+
+// record adds a request to the window, replacing the oldest one if the window
+// is full.
+func (s *requestStats) record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(request{latency: latency, failed: err != nil})
+}
+
+// recordProbe adds a health check to the window and keeps it as the last
+// probe.
+func (s *requestStats) recordProbe(t time.Time, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(request{latency: latency, failed: err != nil})
+	s.lastProbe.time = t
+	s.lastProbe.latency = latency
+	s.lastProbe.err = err
+}
+
+func (s *requestStats) add(r request) {
+	if len(s.requests) < statsWindowSize {
+		s.requests = append(s.requests, r)
+		return
+	}
+	s.requests[s.next] = r
+	s.next = (s.next + 1) % statsWindowSize
+}
+
+// stats returns the statistics of the requests in the window.
+func (s *requestStats) stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		LastProbeTime:    s.lastProbe.time,
+		LastProbeLatency: s.lastProbe.latency,
+		LastProbeError:   s.lastProbe.err,
+		Requests:         len(s.requests),
+	}
+	if len(s.requests) == 0 {
+		return st
+	}
+
+	latencies := make([]time.Duration, len(s.requests))
+	for i, r := range s.requests {
+		latencies[i] = r.latency
+		if r.failed {
+			st.Failures++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	// Nearest-rank percentile
+	idx := (95*len(latencies)+99)/100 - 1
+	st.LatencyP95 = latencies[idx]
+	return st
+}
@@ -3,16 +3,24 @@ package provisioners
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
+	"github.com/go-logr/logr"
 	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
 	capi "github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/ca"
 	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
 )
 
 var collection = new(sync.Map)
@@ -21,28 +29,110 @@ var collection = new(sync.Map)
 // requests using step certificates.
 type Step struct {
 	name        string
-	provisioner *ca.Provisioner
+	generation  int64
+	spec        api.StepIssuerSpec
+	secrets     map[string]string
+	url         string
+	client      *ca.Client
+	provisioner *jwk
+	profiles    map[string]*jwk
+	onDemand    bool
+	fips        bool
+	clock       clock.Clock
+	log         logr.Logger
+	backdate    time.Duration
+	roots       []byte
+	cancel      context.CancelFunc
+
+	requests requestStats
 }
 
 // New returns a new Step provisioner, configured with the information in the
-// given issuer.
+// given issuer. The decrypted provisioner key is kept in memory until the
+// provisioner is released, the password is not retained and it can be zeroed
+// by the caller. It is equivalent to NewWithOptions with a StaticPassword.
 func New(iss *api.StepIssuer, password []byte) (*Step, error) {
+	return NewWithOptions(iss, StaticPassword(password))
+}
+
+// NewOnDemand returns a new Step provisioner like New, but the provisioner key
+// is not kept in memory. The given function is used to get the password and
+// decrypt the key every time a certificate is signed. See WithOnDemandKeys for
+// the limits of this mode.
+func NewOnDemand(iss *api.StepIssuer, password PasswordFunc) (*Step, error) {
+	return NewWithOptions(iss, password, WithOnDemandKeys())
+}
+
+// NewWithOptions returns a new Step provisioner, configured with the
+// information in the given issuer and the given options. The password function
+// is used to decrypt the provisioner key, it is only used once unless
+// WithOnDemandKeys is set. The identity and the clock are set with
+// WithIdentity and WithClock.
+func NewWithOptions(iss *api.StepIssuer, password PasswordFunc, opts ...Option) (*Step, error) {
+	o := newOptions(opts)
+	identity := o.identity
+
+	if o.fips && !FIPSCapable() {
+		return nil, fmt.Errorf("FIPS mode requires a binary built with a FIPS capable crypto backend")
+	}
+
 	var options []ca.ClientOption
-	if len(iss.Spec.CABundle) > 0 {
+	switch {
+	case identity != nil && o.httpClient != nil:
+		return nil, fmt.Errorf("an HTTP client cannot be used with an identity certificate")
+	case o.fips && o.httpClient != nil:
+		return nil, fmt.Errorf("an HTTP client cannot be used in FIPS mode")
+	case identity != nil || o.fips:
+		tr, err := newTransport(iss.Spec.CABundle, identity, o.fips)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, ca.WithTransport(tr))
+	case o.httpClient != nil:
+		tr := o.httpClient.Transport
+		if tr == nil {
+			tr = http.DefaultTransport
+		}
+		options = append(options, ca.WithTransport(tr))
+	case len(iss.Spec.CABundle) > 0:
 		options = append(options, ca.WithCABundle(iss.Spec.CABundle))
 	}
-	provisioner, err := ca.NewProvisioner(iss.Spec.Provisioner.Name, iss.Spec.Provisioner.KeyID, iss.Spec.URL, password, options...)
+	options = append(options, o.caOptions...)
+	client, err := ca.NewClient(iss.Spec.URL, options...)
+	if err != nil {
+		return nil, err
+	}
+	provisioner, err := newJWK(iss.Spec.Provisioner, iss.Spec.URL, client, password, o.onDemand, o.clock)
 	if err != nil {
 		return nil, err
 	}
 
 	p := &Step{
 		name:        iss.Name + "." + iss.Namespace,
+		generation:  iss.Generation,
+		spec:        provisionerSpec(iss.Spec),
+		secrets:     o.secrets,
+		url:         iss.Spec.URL,
+		client:      client,
 		provisioner: provisioner,
+		onDemand:    o.onDemand,
+		fips:        o.fips,
+		clock:       o.clock,
+		log:         o.log.WithValues("stepissuer", iss.Namespace+"/"+iss.Name),
+	}
+	if iss.Spec.Backdate != nil {
+		p.backdate = iss.Spec.Backdate.Duration
+	}
+
+	// The CA might not allow anonymous requests, so there's no need to request
+	// an identity certificate, and the pinned roots will be used.
+	if identity != nil {
+		p.roots = iss.Spec.CABundle
+		return p, nil
 	}
 
 	// Request identity certificate if required.
-	if version, err := provisioner.Version(); err == nil {
+	if version, err := client.Version(); err == nil {
 		if version.RequireClientAuthentication {
 			if err := p.createIdentityCertificate(); err != nil {
 				return nil, err
@@ -53,6 +143,25 @@ func New(iss *api.StepIssuer, password []byte) (*Step, error) {
 	return p, nil
 }
 
+// AddProfile adds a named profile to the provisioner. The certificate requests
+// selecting the profile will be signed using the given JWK provisioner, in the
+// same CA and with the same client configuration as the default one.
+//
+// If the provisioner was created with NewOnDemand or WithOnDemandKeys the
+// password function is used every time a certificate is signed, otherwise it
+// is only used once to decrypt the key.
+func (s *Step) AddProfile(name string, prov api.StepProvisioner, password PasswordFunc) error {
+	provisioner, err := newJWK(prov, s.url, s.client, password, s.onDemand, s.clock)
+	if err != nil {
+		return err
+	}
+	if s.profiles == nil {
+		s.profiles = make(map[string]*jwk)
+	}
+	s.profiles[name] = provisioner
+	return nil
+}
+
 // Load returns a Step provisioner by NamespacedName.
 func Load(namespacedName types.NamespacedName) (*Step, bool) {
 	v, ok := collection.Load(namespacedName)
@@ -63,13 +172,112 @@ func Load(namespacedName types.NamespacedName) (*Step, bool) {
 	return p, ok
 }
 
-// Store adds a new provisioner to the collection by NamespacedName.
+// Store adds a new provisioner to the collection by NamespacedName. If a
+// provisioner was already stored with the same NamespacedName it will be
+// replaced and its resources released.
 func Store(namespacedName types.NamespacedName, provisioner *Step) {
+	if old, ok := Load(namespacedName); ok && old != provisioner {
+		old.Close()
+	}
 	collection.Store(namespacedName, provisioner)
 }
 
+// Delete removes the provisioner with the given NamespacedName from the
+// collection and releases its resources.
+func Delete(namespacedName types.NamespacedName) {
+	if p, ok := Load(namespacedName); ok {
+		p.Close()
+	}
+	collection.Delete(namespacedName)
+}
+
+// Matches returns true if the provisioner was created with the spec of the
+// given StepIssuer and with the given versions of its secrets. The policy and
+// the fallback issuer are not used by the provisioner, so StepIssuers that
+// only differ in them can reuse it.
+func (s *Step) Matches(iss *api.StepIssuer, secretVersions map[string]string) bool {
+	if len(s.secrets) != len(secretVersions) {
+		return false
+	}
+	for name, version := range secretVersions {
+		if v, ok := s.secrets[name]; !ok || v != version {
+			return false
+		}
+	}
+	if s.generation == iss.Generation {
+		return true
+	}
+	return equality.Semantic.DeepEqual(s.spec, provisionerSpec(iss.Spec))
+}
+
+// provisionerSpec returns a copy of the StepIssuer spec without the fields
+// that are not used to create a provisioner.
+func provisionerSpec(spec api.StepIssuerSpec) api.StepIssuerSpec {
+	c := *spec.DeepCopy()
+	c.Policy = nil
+	c.FallbackIssuerName = ""
+	return c
+}
+
+// Probe checks the health of the CA, the latency and outcome of the request
+// are recorded in the provisioner stats.
+func (s *Step) Probe() error {
+	start := s.clock.Now()
+	_, err := s.client.Health()
+	s.requests.recordProbe(start, s.clock.Since(start), err)
+	return err
+}
+
+// Stats returns the latency and outcome of the recent requests to the CA.
+func (s *Step) Stats() Stats {
+	return s.requests.stats()
+}
+
+// Close stops the renewal of the identity certificate if one was requested.
+func (s *Step) Close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// newTransport returns an http.Transport that trusts only the roots in the
+// given bundle, or the system roots if it is empty, and authenticates using the
+// given client certificate, if any. In FIPS mode the TLS configuration is
+// restricted to FIPS approved settings.
+func newTransport(caBundle []byte, identity *tls.Certificate, fips bool) (*http.Transport, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(caBundle) > 0 || identity != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("error parsing CA bundle: no certificates found")
+		}
+		config.RootCAs = pool
+	}
+	if identity != nil {
+		config.Certificates = []tls.Certificate{*identity}
+	}
+	if fips {
+		ConfigureFIPSTLS(config)
+	}
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}, nil
+}
+
 func (s *Step) createIdentityCertificate() error {
-	csr, pk, err := ca.CreateCertificateRequest(s.name)
+	var csr *capi.CertificateRequest
+	var pk crypto.PrivateKey
+	var tlsOptions []ca.TLSOption
+	var err error
+	if s.fips {
+		csr, pk, err = createFIPSCertificateRequest(s.name)
+		tlsOptions = append(tlsOptions, fipsTLSOption)
+	} else {
+		csr, pk, err = ca.CreateCertificateRequest(s.name)
+	}
 	if err != nil {
 		return err
 	}
@@ -77,38 +285,41 @@ func (s *Step) createIdentityCertificate() error {
 	if err != nil {
 		return err
 	}
-	resp, err := s.provisioner.Sign(&capi.SignRequest{
+	resp, err := s.client.Sign(&capi.SignRequest{
 		CsrPEM: *csr,
 		OTT:    token,
 	})
 	if err != nil {
 		return err
 	}
-	tr, err := s.provisioner.Client.Transport(context.Background(), resp, pk)
+	// The identity certificate is renewed in the background until the
+	// provisioner is removed from the collection.
+	ctx, cancel := context.WithCancel(context.Background())
+	tr, err := s.client.Transport(ctx, resp, pk, tlsOptions...)
 	if err != nil {
+		cancel()
 		return err
 	}
-	s.provisioner.Client.SetTransport(tr)
+	s.client.SetTransport(tr)
+	s.cancel = cancel
+	s.log.V(1).Info("requested identity certificate", "subject", s.name)
 	return nil
 }
 
 // Sign sends the certificate requests to the Step CA and returns the signed
-// certificate.
+// certificate. The request is signed with the provisioner of the profile in
+// the profile annotation, or with the default one if it is not set.
 func (s *Step) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]byte, []byte, error) {
-	// Get root certificate(s)
-	roots, err := s.provisioner.Roots()
-	if err != nil {
-		return nil, nil, err
+	provisioner := s.provisioner
+	if name, ok := cr.Annotations[api.ProfileAnnotationKey]; ok {
+		if provisioner, ok = s.profiles[name]; !ok {
+			return nil, nil, fmt.Errorf("profile %q not found", name)
+		}
 	}
 
-	// Encode root certificates
-	var caPem []byte
-	for _, root := range roots.Certificates {
-		b, err := encodeX509(root.Certificate)
-		if err != nil {
-			return nil, nil, err
-		}
-		caPem = append(caPem, b...)
+	caPem, err := s.getRoots()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// decode and check certificate request
@@ -117,13 +328,15 @@ func (s *Step) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]
 		return nil, nil, err
 	}
 
-	sans := append([]string{}, csr.DNSNames...)
-	sans = append(sans, csr.EmailAddresses...)
-	for _, ip := range csr.IPAddresses {
-		sans = append(sans, ip.String())
+	if s.fips {
+		if err := checkFIPS(csr); err != nil {
+			return nil, nil, err
+		}
 	}
-	for _, u := range csr.URIs {
-		sans = append(sans, u.String())
+
+	sans, err := csrSANs(csr)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	subject := csr.Subject.CommonName
@@ -131,23 +344,23 @@ func (s *Step) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]
 		subject = generateSubject(sans)
 	}
 
-	token, err := s.provisioner.Token(subject, sans...)
+	token, err := provisioner.Token(subject, sans...)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var notAfter capi.TimeDuration
-	if cr.Spec.Duration != nil {
-		notAfter.SetDuration(cr.Spec.Duration.Duration)
-	}
+	notBefore, notAfter := s.validity(cr.Spec.Duration)
 
-	resp, err := s.provisioner.Sign(&capi.SignRequest{
+	start := s.clock.Now()
+	resp, err := s.client.Sign(&capi.SignRequest{
 		CsrPEM: capi.CertificateRequest{
 			CertificateRequest: csr,
 		},
-		OTT:      token,
-		NotAfter: notAfter,
+		OTT:       token,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
 	})
+	s.requests.record(s.clock.Since(start), err)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -166,6 +379,50 @@ func (s *Step) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]
 	return certPem, caPem, nil
 }
 
+// validity returns the validity sent to the CA for a certificate with the
+// given duration. With a backdate the validity is sent as absolute times,
+// using our clock instead of the clock of the CA, and the NotAfter is
+// backdated too, so the validity does not exceed the requested duration.
+func (s *Step) validity(duration *metav1.Duration) (notBefore, notAfter capi.TimeDuration) {
+	if s.backdate > 0 {
+		start := s.clock.Now().Add(-s.backdate)
+		notBefore.SetTime(start)
+		if duration != nil {
+			notAfter.SetTime(start.Add(duration.Duration))
+		}
+	} else if duration != nil {
+		notAfter.SetDuration(duration.Duration)
+	}
+	return notBefore, notAfter
+}
+
+// getRoots returns the root certificate(s) in PEM format. Pinned roots are
+// returned if available, otherwise they are requested to the CA.
+func (s *Step) getRoots() ([]byte, error) {
+	if len(s.roots) > 0 {
+		return s.roots, nil
+	}
+
+	// Get root certificate(s)
+	start := s.clock.Now()
+	roots, err := s.client.Roots()
+	s.requests.record(s.clock.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode root certificates
+	var caPem []byte
+	for _, root := range roots.Certificates {
+		b, err := encodeX509(root.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		caPem = append(caPem, b...)
+	}
+	return caPem, nil
+}
+
 // decodeCSR decodes a certificate request in PEM format and returns the
 func decodeCSR(data []byte) (*x509.CertificateRequest, error) {
 	block, rest := pem.Decode(data)
@@ -195,16 +452,16 @@ func encodeX509(cert *x509.Certificate) ([]byte, error) {
 	return caPem.Bytes(), nil
 }
 
-// generateSubject returns the first SAN that is not 127.0.0.1 or localhost. The
-// CSRs generated by the Certificate resource have always those SANs. If no SANs
-// are available `step-issuer-certificate` will be used as a subject is always
-// required.
+// generateSubject returns the first SAN that is not localhost or a loopback
+// address, like 127.0.0.1 or ::1 in dual-stack clusters. The CSRs generated by
+// the Certificate resource have always those SANs. If no SANs are available
+// `step-issuer-certificate` will be used as a subject is always required.
 func generateSubject(sans []string) string {
 	if len(sans) == 0 {
 		return "step-issuer-certificate"
 	}
 	for _, s := range sans {
-		if s != "127.0.0.1" && s != "localhost" {
+		if !isLoopback(s) {
 			return s
 		}
 	}
@@ -0,0 +1,101 @@
+package provisioners
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestStepValidity(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := clocktesting.NewFakeClock(now)
+
+	tests := []struct {
+		name          string
+		backdate      time.Duration
+		duration      *metav1.Duration
+		wantNotBefore time.Time
+		wantNotAfter  time.Time
+	}{
+		{"no backdate", 0, &metav1.Duration{Duration: time.Hour}, time.Time{}, now.Add(time.Hour)},
+		{"no backdate nor duration", 0, nil, time.Time{}, time.Time{}},
+		{"backdate", time.Minute, &metav1.Duration{Duration: time.Hour}, now.Add(-time.Minute), now.Add(time.Hour - time.Minute)},
+		{"backdate without duration", time.Minute, nil, now.Add(-time.Minute), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Step{clock: clk, backdate: tt.backdate}
+			notBefore, notAfter := s.validity(tt.duration)
+			if got := notBefore.RelativeTime(now); !got.Equal(tt.wantNotBefore) {
+				t.Errorf("validity() notBefore = %v, want %v", got, tt.wantNotBefore)
+			}
+			if got := notAfter.RelativeTime(now); !got.Equal(tt.wantNotAfter) {
+				t.Errorf("validity() notAfter = %v, want %v", got, tt.wantNotAfter)
+			}
+		})
+	}
+}
+
+func TestNewSkewedClock(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	fake := clocktesting.NewFakeClock(now)
+
+	if c := NewSkewedClock(fake, 0); c != fake {
+		t.Errorf("NewSkewedClock() with no skew = %v, want %v", c, fake)
+	}
+
+	c := NewSkewedClock(fake, -time.Minute)
+	if got, want := c.Now(), now.Add(-time.Minute); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+	fake.Step(time.Hour)
+	if got, want := c.Since(now), time.Hour-time.Minute; got != want {
+		t.Errorf("Since() = %v, want %v", got, want)
+	}
+}
+
+func TestStepMatches(t *testing.T) {
+	iss := &api.StepIssuer{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Spec: api.StepIssuerSpec{
+			URL: "https://ca.example.com",
+		},
+	}
+	s := &Step{
+		generation: 2,
+		spec:       provisionerSpec(iss.Spec),
+		secrets:    map[string]string{"password": "10"},
+	}
+
+	policyChanged := iss.DeepCopy()
+	policyChanged.Generation = 3
+	policyChanged.Spec.Policy = &api.StepPolicy{AllowedSANTypes: []api.SANType{api.SANTypeDNS}}
+
+	specChanged := iss.DeepCopy()
+	specChanged.Generation = 3
+	specChanged.Spec.URL = "https://other.example.com"
+
+	tests := []struct {
+		name     string
+		iss      *api.StepIssuer
+		versions map[string]string
+		want     bool
+	}{
+		{"same", iss, map[string]string{"password": "10"}, true},
+		{"policy changed", policyChanged, map[string]string{"password": "10"}, true},
+		{"spec changed", specChanged, map[string]string{"password": "10"}, false},
+		{"secret changed", iss, map[string]string{"password": "11"}, false},
+		{"secret deleted", iss, map[string]string{"password": ""}, false},
+		{"secret added", iss, map[string]string{"password": "10", "client": "5"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Matches(tt.iss, tt.versions); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
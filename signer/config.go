@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/provisioners"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadIssuer reads a StepIssuer manifest in YAML or JSON format. The URL and
+// the provisioner of the issuer are required.
+func LoadIssuer(filename string) (*api.StepIssuer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	iss := new(api.StepIssuer)
+	if err := yaml.Unmarshal(b, iss); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	switch {
+	case iss.Spec.URL == "":
+		return nil, fmt.Errorf("error parsing %s: spec.url cannot be empty", filename)
+	case iss.Spec.Provisioner.Name == "":
+		return nil, fmt.Errorf("error parsing %s: spec.provisioner.name cannot be empty", filename)
+	case iss.Spec.Provisioner.KeyID == "":
+		return nil, fmt.Errorf("error parsing %s: spec.provisioner.kid cannot be empty", filename)
+	}
+	if iss.Name == "" {
+		iss.Name = "step-signer"
+	}
+	return iss, nil
+}
+
+// Secrets reads the secrets referenced by a StepIssuer from a directory with
+// the same layout as a Kubernetes secret volume, the key of a secret is read
+// from <dir>/<secret name>/<key>.
+type Secrets string
+
+// Password returns the function used to read the password in the secret
+// referenced by the given selector.
+func (d Secrets) Password(ref api.SecretKeySelector) provisioners.PasswordFunc {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(string(d), ref.Name, ref.Key))
+	}
+}
+
+// ClientCertificate loads the client certificate in the TLS secret with the
+// given reference.
+func (d Secrets) ClientCertificate(ref *api.SecretReference) (*tls.Certificate, error) {
+	dir := filepath.Join(string(d), ref.Name)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, core.TLSCertKey), filepath.Join(dir, core.TLSPrivateKeyKey))
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate from %s: %v", dir, err)
+	}
+	return &cert, nil
+}
+
+// NewProvisioner returns the provisioner of the given StepIssuer, including its
+// profiles, using the given secrets and provisioner options.
+func NewProvisioner(iss *api.StepIssuer, secrets Secrets, opts ...provisioners.Option) (*provisioners.Step, error) {
+	if ref := iss.Spec.ClientCertificateRef; ref != nil {
+		identity, err := secrets.ClientCertificate(ref)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, provisioners.WithIdentity(identity))
+	}
+
+	p, err := provisioners.NewWithOptions(iss, secrets.Password(iss.Spec.Provisioner.PasswordRef), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, profile := range iss.Spec.Profiles {
+		if err := p.AddProfile(profile.Name, profile.Provisioner, secrets.Password(profile.Provisioner.PasswordRef)); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("error initializing profile %s: %v", profile.Name, err)
+		}
+	}
+	return p, nil
+}
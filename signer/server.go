@@ -0,0 +1,216 @@
+package signer
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/provisioners"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxRequestSize is the maximum size of the body of a sign request.
+const maxRequestSize = 1 << 20
+
+// healthProbeInterval is the minimum interval between the probes of the CA
+// made by the health endpoint, the result of the last probe is returned in
+// between.
+const healthProbeInterval = 10 * time.Second
+
+// SignRequest is the body of the requests to the sign endpoint.
+type SignRequest struct {
+	// CSR is the certificate request in PEM format.
+	CSR string `json:"csr"`
+	// Duration is the requested validity of the certificate, the default of
+	// the provisioner is used if it is empty.
+	Duration string `json:"duration,omitempty"`
+	// Profile is the name of the StepIssuer profile used to sign the
+	// certificate, the default provisioner is used if it is empty.
+	Profile string `json:"profile,omitempty"`
+}
+
+// SignResponse is the body of the responses of the sign endpoint.
+type SignResponse struct {
+	// Certificate is the signed certificate and its intermediates in PEM
+	// format.
+	Certificate string `json:"certificate"`
+	// CA is the root certificate(s) of the CA in PEM format.
+	CA string `json:"ca"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Provisioner signs the certificate requests of a Server, it is implemented by
+// *provisioners.Step.
+type Provisioner interface {
+	Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]byte, []byte, error)
+	Probe() error
+}
+
+// Server is an HTTP handler that signs certificate requests with a Step
+// provisioner, applying the same policy as the StepIssuer it was created from.
+//
+// All the requests to the sign endpoint must be authenticated with one of the
+// bearer tokens of the server.
+type Server struct {
+	Provisioner Provisioner
+	Policy      *api.StepPolicy
+	Tokens      []string
+	Log         logr.Logger
+
+	mu        sync.Mutex
+	lastProbe time.Time
+	probeErr  error
+}
+
+// Handler returns the handler with the endpoints of the server:
+//
+//   - POST /1.0/sign signs a SignRequest and returns a SignResponse.
+//   - GET /health returns 200 if the CA is healthy. It does not require
+//     authentication, so the CA is probed at most once every
+//     healthProbeInterval.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.health)
+	mux.Handle("/1.0/sign", s.authenticate(http.HandlerFunc(s.sign)))
+	return mux
+}
+
+// authenticate rejects the requests without a valid bearer token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || !s.isValidToken(strings.TrimPrefix(auth, "Bearer ")) {
+			s.Log.Info("unauthorized request", "remoteAddr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isValidToken compares the given token with all the tokens of the server in
+// constant time.
+func (s *Server) isValidToken(token string) bool {
+	var ok int
+	for _, t := range s.Tokens {
+		ok |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return token != "" && ok == 1
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if err := s.probe(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "CA is not healthy")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// probe returns the result of the last probe of the CA, the CA is probed again
+// if it is older than healthProbeInterval.
+func (s *Server) probe() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastProbe.IsZero() && time.Since(s.lastProbe) < healthProbeInterval {
+		return s.probeErr
+	}
+	s.probeErr = s.Provisioner.Probe()
+	s.lastProbe = time.Now()
+	if s.probeErr != nil {
+		s.Log.Error(s.probeErr, "failed to probe CA")
+	}
+	return s.probeErr
+}
+
+func (s *Server) sign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req SignRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("error decoding request: %v", err))
+		return
+	}
+	cr, err := newCertificateRequest(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log := s.Log.WithValues("remoteAddr", r.RemoteAddr, "profile", req.Profile)
+	if err := provisioners.CheckPolicy(s.Policy, cr); err != nil {
+		log.Info("certificate request rejected by policy", "reason", err.Error())
+		writeError(w, http.StatusForbidden, fmt.Sprintf("certificate request rejected by policy: %v", err))
+		return
+	}
+
+	certPem, caPem, err := s.Provisioner.Sign(r.Context(), cr)
+	if errors.As(err, new(*provisioners.FIPSError)) {
+		log.Info("certificate request rejected in FIPS mode", "reason", err.Error())
+		writeError(w, http.StatusForbidden, fmt.Sprintf("certificate request rejected in FIPS mode: %v", err))
+		return
+	}
+	if err != nil {
+		log.Error(err, "failed to sign certificate request")
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error signing certificate request: %v", err))
+		return
+	}
+
+	log.Info("signed certificate request")
+	writeJSON(w, http.StatusCreated, &SignResponse{
+		Certificate: string(certPem),
+		CA:          string(caPem),
+	})
+}
+
+// newCertificateRequest converts the given request into the CertificateRequest
+// expected by the provisioner.
+func newCertificateRequest(req *SignRequest) (*certmanager.CertificateRequest, error) {
+	if req.CSR == "" {
+		return nil, fmt.Errorf("csr cannot be empty")
+	}
+	cr := &certmanager.CertificateRequest{
+		Spec: certmanager.CertificateRequestSpec{
+			Request: []byte(req.CSR),
+		},
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing duration: %v", err)
+		}
+		cr.Spec.Duration = &meta.Duration{Duration: d}
+	}
+	if req.Profile != "" {
+		cr.Annotations = map[string]string{
+			api.ProfileAnnotationKey: req.Profile,
+		}
+	}
+	return cr, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, &errorResponse{Error: msg})
+}
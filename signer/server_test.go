@@ -0,0 +1,169 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	certmanager "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/provisioners"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const testToken = "test-token"
+
+// fakeProvisioner returns the configured results and counts the probes.
+type fakeProvisioner struct {
+	signErr  error
+	probeErr error
+	probes   int
+}
+
+func (p *fakeProvisioner) Sign(ctx context.Context, cr *certmanager.CertificateRequest) ([]byte, []byte, error) {
+	if p.signErr != nil {
+		return nil, nil, p.signErr
+	}
+	return []byte("certificate"), []byte("root"), nil
+}
+
+func (p *fakeProvisioner) Probe() error {
+	p.probes++
+	return p.probeErr
+}
+
+// newTestCSR returns a certificate request in PEM format for the given DNS
+// names and IP addresses.
+func newTestCSR(t *testing.T, dnsNames []string, ips []net.IP) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServerSign(t *testing.T) {
+	csr := newTestCSR(t, []string{"example.com"}, nil)
+	ipCSR := newTestCSR(t, []string{"example.com"}, []net.IP{net.ParseIP("10.0.0.1")})
+	valid := mustJSON(t, &SignRequest{CSR: csr, Duration: "24h"})
+
+	tests := []struct {
+		name       string
+		method     string
+		auth       string
+		body       string
+		signErr    error
+		wantStatus int
+	}{
+		{"ok", http.MethodPost, "Bearer " + testToken, valid, nil, http.StatusCreated},
+		{"missing authorization", http.MethodPost, "", valid, nil, http.StatusUnauthorized},
+		{"wrong scheme", http.MethodPost, "Basic " + testToken, valid, nil, http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "Bearer other-token", valid, nil, http.StatusUnauthorized},
+		{"empty token", http.MethodPost, "Bearer ", valid, nil, http.StatusUnauthorized},
+		{"method not allowed", http.MethodGet, "Bearer " + testToken, "", nil, http.StatusMethodNotAllowed},
+		{"bad json", http.MethodPost, "Bearer " + testToken, "{", nil, http.StatusBadRequest},
+		{"empty csr", http.MethodPost, "Bearer " + testToken, mustJSON(t, &SignRequest{}), nil, http.StatusBadRequest},
+		{"bad duration", http.MethodPost, "Bearer " + testToken, mustJSON(t, &SignRequest{CSR: csr, Duration: "1 day"}), nil, http.StatusBadRequest},
+		{"rejected by policy", http.MethodPost, "Bearer " + testToken, mustJSON(t, &SignRequest{CSR: ipCSR}), nil, http.StatusForbidden},
+		{"rejected in FIPS mode", http.MethodPost, "Bearer " + testToken, valid, &provisioners.FIPSError{}, http.StatusForbidden},
+		{"sign error", http.MethodPost, "Bearer " + testToken, valid, errors.New("CA is down"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Provisioner: &fakeProvisioner{signErr: tt.signErr},
+				Policy:      &api.StepPolicy{AllowedSANTypes: []api.SANType{api.SANTypeDNS}},
+				Tokens:      []string{testToken},
+				Log:         logf.Log,
+			}
+			req := httptest.NewRequest(tt.method, "/1.0/sign", strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			switch rec.Code {
+			case http.StatusCreated:
+				var resp SignResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Certificate != "certificate" || resp.CA != "root" {
+					t.Errorf("response = %+v, want certificate and root", resp)
+				}
+			case http.StatusUnauthorized:
+				if got := rec.Header().Get("WWW-Authenticate"); got != "Bearer" {
+					t.Errorf("WWW-Authenticate = %q, want Bearer", got)
+				}
+			case http.StatusMethodNotAllowed:
+				if got := rec.Header().Get("Allow"); got != http.MethodPost {
+					t.Errorf("Allow = %q, want %s", got, http.MethodPost)
+				}
+			}
+		})
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		probeErr   error
+		wantStatus int
+	}{
+		{"healthy", nil, http.StatusOK},
+		{"unhealthy", errors.New("CA is down"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakeProvisioner{probeErr: tt.probeErr}
+			s := &Server{Provisioner: p, Log: logf.Log}
+			h := s.Handler()
+
+			// The health endpoint does not require authentication, and the
+			// CA is only probed once within healthProbeInterval.
+			for i := 0; i < 3; i++ {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+				}
+			}
+			if p.probes != 1 {
+				t.Errorf("probes = %d, want 1", p.probes)
+			}
+		})
+	}
+}
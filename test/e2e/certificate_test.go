@@ -0,0 +1,108 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newCertificate(name string, dnsNames ...string) *cmapi.Certificate {
+	return &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: f.Namespace,
+		},
+		Spec: cmapi.CertificateSpec{
+			SecretName: name + "-tls",
+			CommonName: dnsNames[0],
+			DNSNames:   dnsNames,
+			Duration:   &metav1.Duration{Duration: time.Hour},
+			IssuerRef:  f.IssuerRef(),
+		},
+	}
+}
+
+func deleteCertificate(ctx context.Context, crt *cmapi.Certificate) {
+	Expect(client.IgnoreNotFound(f.Client.Delete(ctx, crt))).To(Succeed())
+	secret := &core.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      crt.Spec.SecretName,
+			Namespace: crt.Namespace,
+		},
+	}
+	Expect(client.IgnoreNotFound(f.Client.Delete(ctx, secret))).To(Succeed())
+}
+
+var _ = Describe("Certificate", func() {
+	ctx := context.Background()
+
+	It("should be issued", func() {
+		crt := newCertificate("e2e-issuance", "e2e-issuance.example.com")
+		Expect(f.Client.Create(ctx, crt)).To(Succeed())
+		defer deleteCertificate(ctx, crt)
+
+		crt, err := f.WaitForCertificate(ctx, crt.Name, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		leaf, err := f.VerifiedCertificate(ctx, crt)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(leaf.DNSNames).To(ConsistOf("e2e-issuance.example.com"))
+	})
+
+	It("should be renewed", func() {
+		crt := newCertificate("e2e-renewal", "e2e-renewal.example.com")
+		// Renew 30 seconds after being issued
+		crt.Spec.RenewBefore = &metav1.Duration{Duration: time.Hour - 30*time.Second}
+		Expect(f.Client.Create(ctx, crt)).To(Succeed())
+		defer deleteCertificate(ctx, crt)
+
+		crt, err := f.WaitForCertificate(ctx, crt.Name, 1)
+		Expect(err).ToNot(HaveOccurred())
+		first, err := f.VerifiedCertificate(ctx, crt)
+		Expect(err).ToNot(HaveOccurred())
+
+		crt, err = f.WaitForCertificate(ctx, crt.Name, 2)
+		Expect(err).ToNot(HaveOccurred())
+		second, err := f.VerifiedCertificate(ctx, crt)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(second.SerialNumber).ToNot(Equal(first.SerialNumber))
+		Expect(second.NotAfter.After(first.NotAfter)).To(BeTrue())
+	})
+
+	It("should rotate the private key", func() {
+		crt := newCertificate("e2e-rotation", "e2e-rotation.example.com")
+		crt.Spec.PrivateKey = &cmapi.CertificatePrivateKey{
+			RotationPolicy: cmapi.RotationPolicyAlways,
+		}
+		Expect(f.Client.Create(ctx, crt)).To(Succeed())
+		defer deleteCertificate(ctx, crt)
+
+		crt, err := f.WaitForCertificate(ctx, crt.Name, 1)
+		Expect(err).ToNot(HaveOccurred())
+		first, err := f.VerifiedCertificate(ctx, crt)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Changing the SANs triggers a re-issuance
+		crt.Spec.DNSNames = append(crt.Spec.DNSNames, "e2e-rotation-2.example.com")
+		Expect(f.Client.Update(ctx, crt)).To(Succeed())
+
+		crt, err = f.WaitForCertificate(ctx, crt.Name, 2)
+		Expect(err).ToNot(HaveOccurred())
+		second, err := f.VerifiedCertificate(ctx, crt)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(second.DNSNames).To(ContainElement("e2e-rotation-2.example.com"))
+		Expect(second.PublicKey).ToNot(Equal(first.PublicKey))
+	})
+})
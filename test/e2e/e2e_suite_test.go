@@ -0,0 +1,49 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/test/e2e/framework"
+	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// These tests run against an existing cluster, see hack/e2e.sh to run them
+// in a new kind cluster or for the flags used to point them to any other
+// cluster.
+
+var config framework.Config
+var f *framework.Framework
+
+func init() {
+	framework.RegisterFlags(&config)
+}
+
+func TestE2E(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecsWithDefaultAndCustomReporters(t,
+		"E2E Suite",
+		[]Reporter{printer.NewlineReporter{}})
+}
+
+var _ = BeforeSuite(func() {
+	logf.SetLogger(zap.New(zap.WriteTo(GinkgoWriter)))
+
+	var err error
+	f, err = framework.New(config)
+	Expect(err).ToNot(HaveOccurred())
+
+	By("checking that the StepIssuer under test is ready")
+	_, err = f.WaitForStepIssuer(context.Background(), config.IssuerName, api.ConditionTrue)
+	Expect(err).ToNot(HaveOccurred())
+})
@@ -0,0 +1,112 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	"github.com/smallstep/step-issuer/test/e2e/framework"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newCertificateRequest(name string, issuerRef cmmeta.ObjectReference, dnsNames ...string) *cmapi.CertificateRequest {
+	csr, err := framework.NewCSRWithDNSNames(dnsNames...)
+	Expect(err).ToNot(HaveOccurred())
+	return &cmapi.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: f.Namespace,
+		},
+		Spec: cmapi.CertificateRequestSpec{
+			Request:   csr,
+			Duration:  &metav1.Duration{Duration: time.Hour},
+			IssuerRef: issuerRef,
+		},
+	}
+}
+
+// copyStepIssuer returns a copy of the StepIssuer under test with the given
+// name.
+func copyStepIssuer(ctx context.Context, name string) *api.StepIssuer {
+	iss := new(api.StepIssuer)
+	Expect(f.Client.Get(ctx, f.Key(f.IssuerName), iss)).To(Succeed())
+	return &api.StepIssuer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: f.Namespace,
+		},
+		Spec: *iss.Spec.DeepCopy(),
+	}
+}
+
+var _ = Describe("Failure modes", func() {
+	ctx := context.Background()
+
+	It("should not be ready with a wrong provisioner password", func() {
+		secret := &core.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e2e-wrong-password",
+				Namespace: f.Namespace,
+			},
+			StringData: map[string]string{"password": "not-the-password"},
+		}
+		Expect(f.Client.Create(ctx, secret)).To(Succeed())
+		defer func() {
+			Expect(client.IgnoreNotFound(f.Client.Delete(ctx, secret))).To(Succeed())
+		}()
+
+		iss := copyStepIssuer(ctx, "e2e-wrong-password")
+		iss.Spec.Provisioner.PasswordRef = api.SecretKeySelector{Name: secret.Name, Key: "password"}
+		Expect(f.Client.Create(ctx, iss)).To(Succeed())
+		defer func() {
+			Expect(client.IgnoreNotFound(f.Client.Delete(ctx, iss))).To(Succeed())
+		}()
+
+		_, err := f.WaitForStepIssuer(ctx, iss.Name, api.ConditionFalse)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should keep requests pending for a missing StepIssuer", func() {
+		cr := newCertificateRequest("e2e-missing-issuer", f.IssuerRefFor("e2e-missing-issuer"), "e2e-missing-issuer.example.com")
+		Expect(f.Client.Create(ctx, cr)).To(Succeed())
+		defer func() {
+			Expect(client.IgnoreNotFound(f.Client.Delete(ctx, cr))).To(Succeed())
+		}()
+
+		_, err := f.WaitForCertificateRequest(ctx, cr.Name, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonPending)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject requests not allowed by the StepIssuer policy", func() {
+		iss := copyStepIssuer(ctx, "e2e-policy")
+		iss.Spec.Policy = &api.StepPolicy{
+			AllowedSANTypes: []api.SANType{api.SANTypeIP},
+		}
+		Expect(f.Client.Create(ctx, iss)).To(Succeed())
+		defer func() {
+			Expect(client.IgnoreNotFound(f.Client.Delete(ctx, iss))).To(Succeed())
+		}()
+		_, err := f.WaitForStepIssuer(ctx, iss.Name, api.ConditionTrue)
+		Expect(err).ToNot(HaveOccurred())
+
+		cr := newCertificateRequest("e2e-policy", f.IssuerRefFor(iss.Name), "e2e-policy.example.com")
+		Expect(f.Client.Create(ctx, cr)).To(Succeed())
+		defer func() {
+			Expect(client.IgnoreNotFound(f.Client.Delete(ctx, cr))).To(Succeed())
+		}()
+
+		cr, err = f.WaitForCertificateRequest(ctx, cr.Name, cmmeta.ConditionFalse, cmapi.CertificateRequestReasonFailed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cr.Status.Certificate).To(BeEmpty())
+	})
+})
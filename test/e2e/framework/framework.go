@@ -0,0 +1,266 @@
+// Package framework contains the helpers used by the step-issuer end-to-end
+// tests. The tests run against an existing cluster with cert-manager, step
+// certificates, the step-issuer controller and a ready StepIssuer, so they can
+// be used as a conformance check for any installation.
+package framework
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"time"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	api "github.com/smallstep/step-issuer/api/v1beta1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Config contains the configuration of the environment under test.
+type Config struct {
+	// Namespace is the namespace of the StepIssuer under test, all the test
+	// resources are created in it.
+	Namespace string
+
+	// IssuerName is the name of the StepIssuer under test.
+	IssuerName string
+
+	// Timeout is the maximum time to wait for a resource to reach the
+	// expected state.
+	Timeout time.Duration
+}
+
+// RegisterFlags registers the flags used to configure the environment under
+// test in the default flag set.
+func RegisterFlags(c *Config) {
+	flag.StringVar(&c.Namespace, "e2e.namespace", "default",
+		"The namespace of the StepIssuer under test.")
+	flag.StringVar(&c.IssuerName, "e2e.issuer-name", "step-issuer",
+		"The name of the StepIssuer under test.")
+	flag.DurationVar(&c.Timeout, "e2e.timeout", 3*time.Minute,
+		"The maximum time to wait for a resource to reach the expected state.")
+}
+
+// Framework contains a client to the cluster under test and helpers to
+// create and wait for resources.
+type Framework struct {
+	Config
+	Client client.Client
+}
+
+// New returns a new Framework using the current kubeconfig.
+func New(c Config) (*Framework, error) {
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := cmapi.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	cl, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Framework{
+		Config: c,
+		Client: cl,
+	}, nil
+}
+
+// IssuerRef returns the reference to the StepIssuer under test.
+func (f *Framework) IssuerRef() cmmeta.ObjectReference {
+	return f.IssuerRefFor(f.IssuerName)
+}
+
+// IssuerRefFor returns the reference to the StepIssuer with the given name.
+func (f *Framework) IssuerRefFor(name string) cmmeta.ObjectReference {
+	return cmmeta.ObjectReference{
+		Group: api.GroupVersion.Group,
+		Kind:  "StepIssuer",
+		Name:  name,
+	}
+}
+
+// Key returns the NamespacedName of a resource with the given name in the
+// namespace under test.
+func (f *Framework) Key(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: f.Namespace, Name: name}
+}
+
+// WaitFor polls the given condition every second until it returns true, an
+// error, or the timeout expires.
+func (f *Framework) WaitFor(condition wait.ConditionFunc) error {
+	return wait.PollImmediate(time.Second, f.Timeout, condition)
+}
+
+// WaitForStepIssuer waits until the Ready condition of the given StepIssuer
+// has the given status.
+func (f *Framework) WaitForStepIssuer(ctx context.Context, name string, status api.ConditionStatus) (*api.StepIssuer, error) {
+	iss := new(api.StepIssuer)
+	err := f.WaitFor(func() (bool, error) {
+		if err := f.Client.Get(ctx, f.Key(name), iss); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		for _, c := range iss.Status.Conditions {
+			if c.Type == api.ConditionReady && c.Status == status {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for StepIssuer %s to be Ready=%s: %v", name, status, err)
+	}
+	return iss, nil
+}
+
+// WaitForCertificate waits until the given Certificate is ready with at least
+// the given revision.
+func (f *Framework) WaitForCertificate(ctx context.Context, name string, revision int) (*cmapi.Certificate, error) {
+	crt := new(cmapi.Certificate)
+	err := f.WaitFor(func() (bool, error) {
+		if err := f.Client.Get(ctx, f.Key(name), crt); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		if crt.Status.Revision == nil || *crt.Status.Revision < revision {
+			return false, nil
+		}
+		for _, c := range crt.Status.Conditions {
+			if c.Type == cmapi.CertificateConditionReady && c.Status == cmmeta.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for Certificate %s revision %d to be ready: %v", name, revision, err)
+	}
+	return crt, nil
+}
+
+// WaitForCertificateRequest waits until the Ready condition of the given
+// CertificateRequest has the given status and reason.
+func (f *Framework) WaitForCertificateRequest(ctx context.Context, name string, status cmmeta.ConditionStatus, reason string) (*cmapi.CertificateRequest, error) {
+	cr := new(cmapi.CertificateRequest)
+	err := f.WaitFor(func() (bool, error) {
+		if err := f.Client.Get(ctx, f.Key(name), cr); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		for _, c := range cr.Status.Conditions {
+			if c.Type == cmapi.CertificateRequestConditionReady && c.Status == status && c.Reason == reason {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for CertificateRequest %s to be Ready=%s with reason %s: %v", name, status, reason, err)
+	}
+	return cr, nil
+}
+
+// VerifiedCertificate reads the secret of the given Certificate, and returns
+// the leaf certificate after verifying its chain against the CA in the
+// secret.
+func (f *Framework) VerifiedCertificate(ctx context.Context, crt *cmapi.Certificate) (*x509.Certificate, error) {
+	var secret core.Secret
+	if err := f.Client.Get(ctx, f.Key(crt.Spec.SecretName), &secret); err != nil {
+		return nil, err
+	}
+
+	chain, err := ParseCertificates(secret.Data[core.TLSCertKey])
+	if err != nil {
+		return nil, err
+	}
+	roots, err := ParseCertificates(secret.Data[cmmeta.TLSCAKey])
+	if err != nil {
+		return nil, err
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range roots {
+		opts.Roots.AddCert(c)
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return nil, fmt.Errorf("error verifying certificate in secret %s: %v", secret.Name, err)
+	}
+	return chain[0], nil
+}
+
+// ParseCertificates parses all the certificates in the given PEM data.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// NewCSR returns a new certificate request in PEM format with the given
+// subject and SANs, signed with a new EC P-256 key.
+func NewCSR(template *x509.CertificateRequest) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// NewCSRWithDNSNames returns a new certificate request in PEM format with the
+// given DNS names, the first one is used as the common name.
+func NewCSRWithDNSNames(dnsNames ...string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		DNSNames: dnsNames,
+	}
+	if len(dnsNames) > 0 {
+		template.Subject = pkix.Name{CommonName: dnsNames[0]}
+	}
+	return NewCSR(template)
+}